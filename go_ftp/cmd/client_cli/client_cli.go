@@ -10,6 +10,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_client"
 )
 
@@ -22,6 +23,12 @@ func main() {
 		pIsLogEnabled = flag.Bool("log", false, "Enable logging")
 		pDataIP       = flag.String("data-ip", "", "Data socket addr")
 		pOutDir       = flag.String("out", "./", "The folder which downloads will be saved.")
+		pVerify       = flag.Bool("verify", false, "Verify downloaded files using the HASH command")
+		pCharset      = flag.String("charset", "", "Charset of file names if the server doesn't support UTF-8, e.g. ISO-8859-1")
+		pCompress     = flag.Bool("z", false, "Use MODE Z compression if the server supports it")
+		pFxpAddr      = flag.String("fxp", "", "Transfer the files listed as commands directly to this FTP server (FXP)")
+		pFxpUser      = flag.String("fxp-u", "", "FXP destination user name, defaults to -u")
+		pFxpPw        = flag.String("fxp-pw", "", "FXP destination password, defaults to -pw")
 	)
 	flag.Parse()
 	user, pw, it, isLogEnabled, dataIP, outDir := *pUser, *pPw, *pIt, *pIsLogEnabled, *pDataIP, *pOutDir
@@ -42,6 +49,7 @@ func main() {
 		log.Fatal(err)
 	}
 	defer conn.Close()
+	client.SetVerify(*pVerify)
 
 	// Read server welcome message
 	status, welcomeMsg, err := client.ReadWelcomeMessage()
@@ -56,6 +64,38 @@ func main() {
 	}
 	log.Printf("Authentication successful.\n")
 
+	if *pCharset != "" {
+		charset, err := ftp_charset.Lookup(*pCharset)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.SetFallbackCharset(charset)
+	}
+	utf8, err := client.EnableUTF8()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("UTF-8 file names: %t.\n", utf8)
+
+	if *pCompress {
+		compressed, err := client.EnableCompression()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("MODE Z compression enabled: %t.\n", compressed)
+	}
+
+	if *pFxpAddr != "" {
+		fxpUser, fxpPw := *pFxpUser, *pFxpPw
+		if fxpUser == "" {
+			fxpUser, fxpPw = user, pw
+		}
+		if err := fxp(client, *pFxpAddr, fxpUser, fxpPw, cmds); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Fatal(client.ProcessCommands())
 }
 
@@ -92,5 +132,36 @@ func initFtpClient(srvAddr, dataIP, outDir, cmds string, it bool) (*ftp_client.F
 	if err != nil {
 		return nil, nil, err
 	}
+	client.SetHost(srvAddr)
 	return client, ctrlConn, nil
 }
+
+// fxp transfers every "src [dst]" line of transfers from the server of src to the server at dstAddr.
+func fxp(src *ftp_client.FtpClient, dstAddr, user, pw, transfers string) error {
+	dst, conn, err := initFtpClient(dstAddr, "", "./", "", false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, _, err := dst.ReadWelcomeMessage(); err != nil {
+		return err
+	}
+	if err := dst.Authenticate(user, pw); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(transfers, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		srcPath, dstPath := fields[0], fields[0]
+		if len(fields) > 1 {
+			dstPath = fields[1]
+		}
+		if err := src.TransferTo(dst, srcPath, dstPath); err != nil {
+			return err
+		}
+		fmt.Printf("%s transferred to %s:%s.\n", srcPath, dstAddr, dstPath)
+	}
+	return nil
+}
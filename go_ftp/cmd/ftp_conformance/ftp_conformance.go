@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_client"
+)
+
+var (
+	pUser    = flag.String("u", "", "FTP server user name")
+	pPw      = flag.String("pw", "", "FTP server password")
+	pTimeout = flag.Duration("timeout", 10*time.Second, "Time limit of each scenario.")
+	pRun     = flag.String("run", "", "Only run the scenarios whose name matches this regular expression.")
+	pVerbose = flag.Bool("v", false, "Print the replies of passing scenarios too.")
+)
+
+// Runs a catalog of RFC 959 scenarios against a FTP server and reports pass or fail per scenario together
+// with the replies received. Exits with status 1 if any scenario fails.
+//
+// Usage: ftp_conformance -u <user> -pw <password> [flags] <host:port>
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || *pUser == "" || *pPw == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s -u <user> -pw <password> [flags] <host:port>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	filter, err := regexp.Compile(*pRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The client logs every reply, the replies are reported per scenario instead.
+	log.SetOutput(ioutil.Discard)
+
+	cfg := config{addr: flag.Arg(0), user: *pUser, password: *pPw, timeout: *pTimeout}
+	passed, failed := 0, 0
+	for _, s := range scenarios {
+		if !filter.MatchString(s.name) {
+			continue
+		}
+		t := run(s, cfg)
+		if t.err == nil {
+			passed++
+			fmt.Printf("PASS %s\n", s.name)
+		} else {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", s.name, t.err)
+		}
+		if t.err != nil || *pVerbose {
+			for _, line := range t.transcript {
+				fmt.Printf("     %s\n", strings.Replace(line, "\n", "\n     ", -1))
+			}
+		}
+	}
+	fmt.Printf("%d passed, %d failed.\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// config is the server the scenarios run against.
+type config struct {
+	addr     string
+	user     string
+	password string
+	timeout  time.Duration
+}
+
+type scenario struct {
+	name string
+	// login tells whether the scenario starts logged in.
+	login bool
+	// run returns an error at the first failed expectation, which ends the scenario.
+	run func(t *tester) error
+}
+
+// tester runs a scenario on its own connection and records the commands sent and the replies received.
+type tester struct {
+	config
+	client     *ftp_client.FtpClient
+	conn       net.Conn
+	transcript []string
+	err        error
+}
+
+// run runs s on a new connection, the result is in the err of the returned tester.
+func run(s scenario, cfg config) *tester {
+	t := &tester{config: cfg}
+	t.err = t.run(s)
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	return t
+}
+
+func (t *tester) run(s scenario) error {
+	conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	t.conn = conn
+	t.client, err = ftp_client.New(strings.NewReader(""), conn, "", "")
+	if err != nil {
+		return err
+	}
+	reply, err := t.client.ReadReply()
+	if err := t.record("", reply, err); err != nil {
+		return err
+	}
+	if err := expectStatus(reply, 220); err != nil {
+		return err
+	}
+	if s.login {
+		if err := t.login(t.password); err != nil {
+			return err
+		}
+	}
+	return s.run(t)
+}
+
+// login logs in with password and expects it to succeed.
+func (t *tester) login(password string) error {
+	if _, err := t.expect("USER", t.user, 331); err != nil {
+		return err
+	}
+	_, err := t.expect("PASS", password, 230)
+	return err
+}
+
+// expect sends a command and returns an error unless the reply has one of the expected status codes.
+func (t *tester) expect(cmd, arg string, statuses ...int) (ftp_client.Reply, error) {
+	reply, err := t.client.Command(cmd, arg)
+	if err := t.record(commandLine(cmd, arg), reply, err); err != nil {
+		return reply, err
+	}
+	return reply, expectStatus(reply, statuses...)
+}
+
+// transfer runs a data command and returns an error unless it succeeds.
+func (t *tester) transfer(setup, cmd, arg string, upload []byte) ([]byte, error) {
+	data, replies, err := t.client.Transfer(setup, cmd, arg, upload, t.timeout)
+	t.transcript = append(t.transcript, "> "+setup)
+	for i, reply := range replies {
+		if i == 1 {
+			t.transcript = append(t.transcript, "> "+commandLine(cmd, arg))
+		}
+		t.transcript = append(t.transcript, "< "+reply.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", setup, cmd, err)
+	}
+	last := replies[len(replies)-1]
+	if len(replies) != 3 || last.Status != 226 && last.Status != 250 {
+		return nil, fmt.Errorf("%s expected 150 followed by 226, got %s", cmd, last)
+	}
+	return data, nil
+}
+
+func (t *tester) record(line string, reply ftp_client.Reply, err error) error {
+	if line != "" {
+		t.transcript = append(t.transcript, "> "+line)
+	}
+	if err != nil {
+		return err
+	}
+	t.transcript = append(t.transcript, "< "+reply.String())
+	return nil
+}
+
+func expectStatus(reply ftp_client.Reply, statuses ...int) error {
+	for _, status := range statuses {
+		if reply.Status == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %v, got %s", statuses, reply)
+}
+
+func commandLine(cmd, arg string) string {
+	if cmd == "PASS" {
+		return "PASS ****"
+	}
+	if arg == "" {
+		return cmd
+	}
+	return cmd + " " + arg
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
+)
+
+func startServer(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "ftp_conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := ftp_server.New(root, "127.0.0.1", "0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() {
+		srv.Stop()
+		os.RemoveAll(root)
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+	cfg := config{addr: addr, user: "demo", password: "password", timeout: 5 * time.Second}
+
+	// The scenarios of commands that the server implements, it has no NOOP, SYST, CDUP and TYPE yet.
+	supported := regexp.MustCompile(`^(login.*|errors/(file-not-found|bad-sequence)|transfer/.*|list/format|rename|dele|quit)$`)
+	for _, s := range scenarios {
+		if !supported.MatchString(s.name) {
+			continue
+		}
+		if tester := run(s, cfg); tester.err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v. Scenario %s: %q", tester.err, nil, s.name, tester.transcript)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+	cfg := config{addr: addr, user: "demo", password: "wrong", timeout: 5 * time.Second}
+
+	var tests = []struct {
+		scenario    scenario
+		expectedErr string
+		expected    []string
+	}{
+		{scenarios[0], "expected [230], got 530 Login failed.",
+			[]string{"< 220 Service ready.", "> USER demo", "< 331 Password required for demo.", "> PASS ****", "< 530 Login failed."}},
+		// The scenario stops at the first failure, NOOP isn't sent.
+		{scenario{"stop", false, func(t *tester) error {
+			return t.steps(step{"PWD", "", []int{257}}, step{"NOOP", "", []int{200}})
+		}}, "expected [257], got 530 Please login with USER and PASS.",
+			[]string{"< 220 Service ready.", "> PWD", "< 530 Please login with USER and PASS."}},
+	}
+	for _, test := range tests {
+		tester := run(test.scenario, cfg)
+		if tester.err == nil || tester.err.Error() != test.expectedErr {
+			t.Errorf("Error actual = %v, and Expected = %v.", tester.err, test.expectedErr)
+		}
+		if len(tester.transcript) != len(test.expected) {
+			t.Errorf("Error actual = %q, and Expected = %q.", tester.transcript, test.expected)
+			continue
+		}
+		for i := range test.expected {
+			if tester.transcript[i] != test.expected[i] {
+				t.Errorf("Error actual = %q, and Expected = %q.", tester.transcript[i], test.expected[i])
+			}
+		}
+	}
+}
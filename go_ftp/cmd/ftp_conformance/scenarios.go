@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var content = []byte("FTP conformance test file.\r\nSecond line.\r\n")
+
+// unixListLine matches a line of "ls -l" style LIST output.
+var unixListLine = regexp.MustCompile(`^[-dlbcps][-rwxsStT]{9}[+@.]?\s+\d+\s+\S+\s+\S+\s+\d+\s+\w{3}\s+\d{1,2}\s+(\d{1,2}:\d{2}|\d{4})\s+(.+)$`)
+
+var scenarios = []scenario{
+	{"login", false, func(t *tester) error {
+		return t.login(t.password)
+	}},
+	{"login/wrong-password", false, func(t *tester) error {
+		return t.steps(step{"USER", t.user, []int{331}}, step{"PASS", t.password + "-wrong", []int{530}})
+	}},
+	{"login/required", false, func(t *tester) error {
+		return t.steps(step{"PWD", "", []int{530}}, step{"LIST", "", []int{530}})
+	}},
+	{"errors/unknown-command", true, func(t *tester) error {
+		return t.steps(step{"XYZZY", "", []int{500, 502}}, step{"NOOP", "", []int{200}})
+	}},
+	{"errors/missing-argument", true, func(t *tester) error {
+		return t.steps(step{"RETR", "", []int{501}}, step{"NOOP", "", []int{200}})
+	}},
+	{"errors/file-not-found", true, func(t *tester) error {
+		return t.steps(
+			step{"PASV", "", []int{227}},
+			step{"RETR", "conformance-missing-file", []int{550}},
+			step{"DELE", "conformance-missing-file", []int{550}},
+			step{"CWD", "conformance-missing-dir", []int{550}})
+	}},
+	{"errors/bad-sequence", true, func(t *tester) error {
+		return t.steps(step{"RNTO", "conformance-file", []int{503}})
+	}},
+	{"noop", true, func(t *tester) error {
+		return t.steps(step{"NOOP", "", []int{200}})
+	}},
+	{"syst", true, func(t *tester) error {
+		return t.steps(step{"SYST", "", []int{215}})
+	}},
+	{"pwd-cwd", true, func(t *tester) error {
+		reply, err := t.expect("PWD", "", 257)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(reply.Text, `"`) {
+			return fmt.Errorf("PWD reply doesn't start with a quoted path: %s", reply)
+		}
+		return t.steps(step{"CWD", "/", []int{250}}, step{"CDUP", "", []int{200, 250}})
+	}},
+	{"type", true, func(t *tester) error {
+		return t.steps(
+			step{"TYPE", "I", []int{200}},
+			step{"TYPE", "A", []int{200}},
+			step{"TYPE", "A N", []int{200}},
+			step{"TYPE", "X", []int{501, 504}})
+	}},
+	{"transfer/pasv", true, func(t *tester) error {
+		return roundTrip(t, "PASV")
+	}},
+	{"transfer/epsv", true, func(t *tester) error {
+		return roundTrip(t, "EPSV")
+	}},
+	{"transfer/port", true, func(t *tester) error {
+		return roundTrip(t, "PORT")
+	}},
+	{"list/format", true, func(t *tester) error {
+		name, err := upload(t)
+		if err != nil {
+			return err
+		}
+		defer cleanup(t, name)
+		listing, err := t.transfer("PASV", "LIST", "", nil)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, line := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.HasPrefix(line, "total ") {
+				continue
+			}
+			match := unixListLine.FindStringSubmatch(line)
+			if match == nil {
+				return fmt.Errorf("LIST line not in ls -l format: %q", line)
+			}
+			found = found || match[2] == name
+		}
+		if !found {
+			return fmt.Errorf("LIST doesn't contain %s", name)
+		}
+		return nil
+	}},
+	{"rest", true, func(t *tester) error {
+		name, err := upload(t)
+		if err != nil {
+			return err
+		}
+		defer cleanup(t, name)
+		if err := t.steps(step{"TYPE", "I", []int{200}}, step{"REST", "5", []int{350}}); err != nil {
+			return err
+		}
+		data, err := t.transfer("PASV", "RETR", name, nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, content[5:]) {
+			return fmt.Errorf("RETR after REST 5 returned %q, expected %q", data, content[5:])
+		}
+		return nil
+	}},
+	{"rename", true, func(t *tester) error {
+		name, err := upload(t)
+		if err != nil {
+			return err
+		}
+		renamed := name + ".renamed"
+		defer cleanup(t, name, renamed)
+		if err := t.steps(step{"RNFR", name, []int{350}}, step{"RNTO", renamed, []int{250}}); err != nil {
+			return err
+		}
+		data, err := t.transfer("PASV", "RETR", renamed, nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, content) {
+			return fmt.Errorf("Renamed file contains %q, expected %q", data, content)
+		}
+		return t.steps(step{"PASV", "", []int{227}}, step{"RETR", name, []int{550}})
+	}},
+	{"dele", true, func(t *tester) error {
+		name, err := upload(t)
+		if err != nil {
+			return err
+		}
+		defer cleanup(t, name)
+		return t.steps(step{"DELE", name, []int{250}}, step{"DELE", name, []int{550}})
+	}},
+	{"quit", true, func(t *tester) error {
+		return t.steps(step{"QUIT", "", []int{221}})
+	}},
+}
+
+// step is a command and the status codes of the replies that are expected to it.
+type step struct {
+	cmd      string
+	arg      string
+	statuses []int
+}
+
+// steps sends the commands of steps in order and stops at the first unexpected reply.
+func (t *tester) steps(steps ...step) error {
+	for _, s := range steps {
+		if _, err := t.expect(s.cmd, s.arg, s.statuses...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip uploads a file and downloads it again using setup for the data connections. The transfers use
+// the default ASCII type, content already has CRLF line endings.
+func roundTrip(t *tester, setup string) error {
+	name := uniqueName()
+	defer cleanup(t, name)
+	if _, err := t.transfer(setup, "STOR", name, content); err != nil {
+		return err
+	}
+	data, err := t.transfer(setup, "RETR", name, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, content) {
+		return fmt.Errorf("RETR returned %q, expected %q", data, content)
+	}
+	return nil
+}
+
+// upload stores a new file and returns its name.
+func upload(t *tester) (string, error) {
+	name := uniqueName()
+	_, err := t.transfer("PASV", "STOR", name, content)
+	return name, err
+}
+
+// cleanup deletes files created by a scenario, ignoring any errors.
+func cleanup(t *tester, names ...string) {
+	t.conn.SetDeadline(time.Now().Add(t.timeout))
+	for _, name := range names {
+		t.client.Command("DELE", name)
+	}
+}
+
+func uniqueName() string {
+	return fmt.Sprintf("conformance-%d.txt", time.Now().UnixNano())
+}
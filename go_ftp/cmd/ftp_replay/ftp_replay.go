@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_record"
+)
+
+var (
+	pPw      = flag.String("pw", "", "Password sent in place of redacted passwords.")
+	pTimeout = flag.Duration("timeout", 5*time.Second, "How long to wait for each reply.")
+)
+
+// Replays a transcript recorded by the server (see -record-dir of server_cli) against a server and prints
+// the replies that differ. Exits with status 1 if there are differences.
+//
+// Usage: ftp_replay [flags] <host:port> <transcript>
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <host:port> <transcript>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	addr, path := flag.Arg(0), flag.Arg(1)
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := ftp_record.ParseTranscript(file)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	diffs, err := ftp_record.Replay(conn, entries, *pPw, *pTimeout)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, diff := range diffs {
+		command := diff.Command
+		if command == "" {
+			command = "(welcome)"
+		}
+		fmt.Printf("> %s\n", command)
+		for _, line := range diff.Expected {
+			fmt.Printf("- %s\n", line)
+		}
+		for _, line := range diff.Actual {
+			fmt.Printf("+ %s\n", line)
+		}
+	}
+	if len(diffs) > 0 || err != nil {
+		os.Exit(1)
+	}
+	fmt.Printf("%d steps replayed without differences.\n", len(ftp_record.Steps(entries)))
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_activation"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_filter"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_lock"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
 )
 
@@ -11,12 +21,184 @@ var (
 	pRoot = flag.String("root", "/tmp", "Root directory of FTP server.")
 	pPort = flag.String("port", "10000", "Control connection port.")
 	pIP   = flag.String("ip", "", "Control connection addr.")
+
+	pFollowSymlinks = flag.Bool("follow-symlinks", false, "Follow symlinks that point outside of root.")
+	pFxpUsers       = flag.String("fxp-users", "", "Comma separated list of users allowed to do FXP transfers.")
+	pCharset        = flag.String("charset", "", "Charset of file names for clients that don't enable UTF-8, e.g. ISO-8859-1.")
+	pAdmins         = flag.String("admins", "", "Comma separated list of users allowed to use administrative SITE commands.")
+	pAnyPasvIP      = flag.Bool("any-pasv-ip", false, "Accept passive data connections from other IPs than the client's.")
+	pAdminAddr      = flag.String("admin", "", "Serve the admin HTTP API on this addr, e.g. 127.0.0.1:10080.")
+	pAdminToken     = flag.String("admin-token", "", "Bearer token required by the admin HTTP API, must be set with -admin.")
+	pMounts         = flag.String("mounts", "", "Comma separated list of mounts, e.g. /releases=/mnt/releases:ro,/uploads=/mnt/uploads.")
+	pLockWait       = flag.Duration("lock-wait", 0, "How long deletes and renames wait for downloads of the file to finish, zero rejects them.")
+	pRecordDir      = flag.String("record-dir", "", "Record the control connection of every session to a transcript in this directory.")
+	pProxies        = flag.String("trusted-proxies", "", "Comma separated list of IPs and CIDRs allowed to send PROXY protocol headers.")
+	pInetd          = flag.Bool("inetd", false, "Serve a single session over stdin and stdout, as started by inetd or a systemd socket with Accept=yes.")
+	pListenFDs      = flag.Bool("listen-fds", false, "Accept connections on the listeners passed in LISTEN_FDS by a systemd socket with Accept=no.")
+	pLogFile        = flag.String("log-file", "", "Append the log to this file instead of stderr. In inetd mode the log is discarded by default.")
+	pAuthURL        = flag.String("auth-url", "", "Check logins by POSTing them as JSON to this URL.")
+	pAuthCommand    = flag.String("auth-command", "", "Check logins by running this program with the login as JSON on stdin.")
+	pAuthTimeout    = flag.Duration("auth-timeout", 5*time.Second, "Timeout of -auth-url and -auth-command.")
+	pAuthCache      = flag.Duration("auth-cache", time.Minute, "How long answers of -auth-url and -auth-command are cached, zero disables caching.")
+	pTLSCert        = flag.String("tls-cert", "", "Certificate file, protects the control connection with implicit TLS together with -tls-key. Data connections are only protected after PBSZ 0 and PROT P.")
+	pTLSKey         = flag.String("tls-key", "", "Private key file of -tls-cert.")
+	pClientCA       = flag.String("client-ca", "", "CA certificates file, clients with a certificate issued by them log in without password.")
+	pCertUsers      = flag.String("cert-users", "", "Comma separated list of rules mapping client certificates to users, e.g. cn:backup-*=backup,dns:*.example.com. Required by -client-ca.")
+	pUploadRules    = flag.String("upload-rules", "", "JSON file with a list of upload rules, e.g. [{\"dir\": \"/csv\", \"allow_ext\": [\"csv\"], \"max_size\": 10485760}].")
+	pTOTPSecrets    = flag.String("totp-secrets", "", "File of \"user secret [host]\" lines, the users must append a TOTP code to their password.")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "totp-enroll" {
+		enrollTOTP(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	if *pInetd && *pListenFDs {
+		log.Fatal("-inetd and -listen-fds can't be combined")
+	}
+	setupLog()
 	root, port, ip := *pRoot, *pPort, *pIP
-	log.Printf("Starting FTP server on port: %s, with root: %s.\n", ip+":"+port, root)
 	ftpserver := ftp_server.New(root, ip, port)
-	log.Fatal(ftpserver.Start())
+	ftpserver.SetFollowSymlinks(*pFollowSymlinks)
+	ftpserver.AllowAnyPassiveIP(*pAnyPasvIP)
+	if *pFxpUsers != "" {
+		ftpserver.AllowFXP(strings.Split(*pFxpUsers, ",")...)
+	}
+	if *pCharset != "" {
+		if err := ftpserver.SetFallbackCharset(*pCharset); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pAdmins != "" {
+		ftpserver.SetAdmins(strings.Split(*pAdmins, ",")...)
+	}
+	if *pAuthURL != "" && *pAuthCommand != "" {
+		log.Fatal("-auth-url and -auth-command can't be combined")
+	}
+	if *pAuthURL != "" || *pAuthCommand != "" {
+		auth, err := authenticator()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ftpserver.SetAuthenticator(auth)
+	}
+	if *pTLSCert != "" || *pTLSKey != "" {
+		if err := setupTLS(ftpserver); err != nil {
+			log.Fatal(err)
+		}
+	} else if *pClientCA != "" {
+		log.Fatal("-client-ca requires -tls-cert and -tls-key")
+	}
+	if *pUploadRules != "" {
+		if err := loadUploadRules(ftpserver, *pUploadRules); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pTOTPSecrets != "" {
+		if err := loadTOTPSecrets(ftpserver, *pTOTPSecrets); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pRecordDir != "" {
+		ftpserver.SetRecordDir(*pRecordDir)
+	}
+	if *pLockWait > 0 {
+		ftpserver.SetLockPolicy(ftp_lock.Wait, *pLockWait)
+	}
+	if *pMounts != "" {
+		for _, mount := range strings.Split(*pMounts, ",") {
+			if err := addMount(ftpserver, mount); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if *pProxies != "" {
+		if err := ftpserver.SetTrustedProxies(strings.Split(*pProxies, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pAdminAddr != "" {
+		if err := ftpserver.StartAdmin(*pAdminAddr, *pAdminToken); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case *pInetd:
+		ftpserver.ServeConn(ftp_activation.StdioConn())
+	case *pListenFDs:
+		listeners, err := ftp_activation.Listeners()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(listeners) == 0 {
+			log.Fatal("No listeners passed in LISTEN_FDS")
+		}
+		for _, ln := range listeners {
+			log.Printf("Starting FTP server on %s, with root: %s.\n", ln.Addr(), root)
+		}
+		log.Fatal(ftpserver.Serve(listeners...))
+	default:
+		log.Printf("Starting FTP server on port: %s, with root: %s.\n", ip+":"+port, root)
+		log.Fatal(ftpserver.Start())
+	}
+}
+
+// setupLog directs the log to the log file. Under inetd stderr may be the client's connection too, so the
+// log is discarded unless there is a log file.
+func setupLog() {
+	if *pLogFile != "" {
+		file, err := os.OpenFile(*pLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(file)
+	} else if *pInetd {
+		log.SetOutput(ioutil.Discard)
+	}
+}
+
+// authenticator returns the external authenticator configured by -auth-url or -auth-command.
+func authenticator() (ftp_auth.Authenticator, error) {
+	var auth ftp_auth.Authenticator
+	if *pAuthURL != "" {
+		auth = ftp_auth.NewHTTP(*pAuthURL, *pAuthTimeout)
+	} else {
+		args := strings.Fields(*pAuthCommand)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("-auth-command requires a program")
+		}
+		auth = ftp_auth.NewCommand(*pAuthTimeout, args[0], args[1:]...)
+	}
+	if *pAuthCache > 0 {
+		auth = ftp_auth.NewCache(auth, *pAuthCache)
+	}
+	return auth, nil
+}
+
+// loadUploadRules reads the upload rules from a JSON file.
+func loadUploadRules(ftpserver *ftp_server.FtpServer, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []ftp_filter.Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("Invalid upload rules in %s: %s", path, err)
+	}
+	ftpserver.SetUploadRules(rules...)
+	return nil
+}
+
+// addMount adds a mount given as "dir=root", or "dir=root:ro" for read-only mounts.
+func addMount(ftpserver *ftp_server.FtpServer, mount string) error {
+	parts := strings.SplitN(mount, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid mount %s", mount)
+	}
+	root, readOnly := parts[1], false
+	if strings.HasSuffix(root, ":ro") {
+		root, readOnly = strings.TrimSuffix(root, ":ro"), true
+	}
+	return ftpserver.Mount(parts[0], root, readOnly)
 }
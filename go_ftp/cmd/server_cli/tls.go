@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
+)
+
+// setupTLS enables TLS on the control connection, and on data connections after PROT P, with the
+// certificate of -tls-cert and -tls-key, and client certificate logins if -client-ca is given.
+func setupTLS(ftpserver *ftp_server.FtpServer) error {
+	cert, err := tls.LoadX509KeyPair(*pTLSCert, *pTLSKey)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *pClientCA != "" {
+		// Mapping every certificate of the CA to its common name would log in as any user, the rules must be
+		// explicit.
+		if *pCertUsers == "" {
+			return fmt.Errorf("-client-ca requires -cert-users")
+		}
+		pem, err := ioutil.ReadFile(*pClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates in %s", *pClientCA)
+		}
+		var rules []ftp_auth.CertRule
+		for _, s := range strings.Split(*pCertUsers, ",") {
+			rule, err := ftp_auth.ParseCertRule(s)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = pool
+		ftpserver.SetCertificateMapper(ftp_auth.NewCertMapper(pool, rules...))
+	}
+	ftpserver.SetTLSConfig(config)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_totp"
+)
+
+// enrollTOTP implements the "totp-enroll" subcommand, which generates a TOTP secret for a user, of a virtual
+// host with -host, and prints the otpauth URI to import into an authenticator app. With -secrets the secret is
+// appended to the secrets file read by the server.
+func enrollTOTP(args []string) {
+	flags := flag.NewFlagSet("totp-enroll", flag.ExitOnError)
+	user := flags.String("user", "", "User to enroll.")
+	host := flags.String("host", "", "Virtual host of the user, the default host if empty.")
+	issuer := flags.String("issuer", "go_ftp", "Issuer shown by authenticator apps.")
+	secrets := flags.String("secrets", "", "Append the secret to this TOTP secrets file.")
+	flags.Parse(args)
+	if *user == "" || strings.ContainsAny(*user, " \t") {
+		log.Fatal("totp-enroll requires a -user without spaces")
+	}
+	if strings.ContainsAny(*host, " \t") {
+		log.Fatal("totp-enroll requires a -host without spaces")
+	}
+	secret, err := ftp_totp.GenerateSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *secrets != "" {
+		file, err := os.OpenFile(*secrets, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := fmt.Fprintln(file, strings.TrimSpace(*user+" "+secret+" "+*host)); err != nil {
+			log.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Secret: %s\n", secret)
+	account := *user
+	if *host != "" {
+		account += "@" + *host
+	}
+	fmt.Printf("URI: %s\n", ftp_totp.URI(*issuer, account, secret))
+}
+
+// loadTOTPSecrets requires a TOTP code from the users in the secrets file, which has a "user secret" line per
+// user of the default host and a "user secret host" line per user of a virtual host. Empty lines and lines
+// starting with # are ignored.
+func loadTOTPSecrets(ftpserver *ftp_server.FtpServer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return fmt.Errorf("Invalid TOTP secret on line %d of %s", n, path)
+		}
+		host := ""
+		if len(fields) == 3 {
+			host = fields[2]
+		}
+		if err := ftpserver.SetTOTP(host, fields[0], fields[1]); err != nil {
+			return fmt.Errorf("%s on line %d of %s", err, n, path)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,110 @@
+package ftp_activation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The first file descriptor passed by systemd socket activation, see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// Listeners returns the listeners passed by systemd socket activation (a socket unit with Accept=no), in the
+// order of the socket unit. It returns no listeners if the process wasn't started by socket activation. The
+// LISTEN_* environment variables are unset so that they aren't inherited by child processes.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	n, err := ListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"))
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("File descriptor %d is not a listening socket: %s", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// ListenFDs returns the number of file descriptors passed to this process according to the values of the
+// LISTEN_PID and LISTEN_FDS environment variables. The descriptors are meant for another process if
+// LISTEN_PID isn't the pid of this process.
+func ListenFDs(pid, fds string) (int, error) {
+	if pid == "" || fds == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return 0, errors.New("Invalid LISTEN_PID " + pid)
+	}
+	if p != os.Getpid() {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid LISTEN_FDS " + fds)
+	}
+	return n, nil
+}
+
+// StdioConn returns the connection that inetd, xinetd or systemd (a socket unit with Accept=yes) passes as
+// standard input and output. If standard input isn't a socket, e.g. when testing from a shell, the returned
+// connection reads from standard input and writes to standard output.
+func StdioConn() net.Conn {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return conn
+	}
+	return NewPipeConn(os.Stdin, os.Stdout)
+}
+
+// NewPipeConn returns a connection that reads from r and writes to w. It has no network addresses, so the
+// checks that passive data connections come from the client are skipped.
+func NewPipeConn(r io.ReadCloser, w io.WriteCloser) net.Conn {
+	return &pipeConn{r: r, w: w}
+}
+
+// pipeConn is a net.Conn that doesn't support deadlines.
+type pipeConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *pipeConn) Close() error {
+	err := c.r.Close()
+	if werr := c.w.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr("stdout") }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr("stdin") }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,73 @@
+package ftp_activation_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_activation"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func TestListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	var tests = []struct {
+		pid         string
+		fds         string
+		expected    int
+		expectedErr error
+	}{
+		{"", "", 0, nil},
+		{pid, "2", 2, nil},
+		{pid, "0", 0, nil},
+		{strconv.Itoa(os.Getpid() + 1), "2", 0, nil},
+		{"abc", "2", 0, errors.New("Invalid LISTEN_PID abc")},
+		{pid, "-1", 0, errors.New("Invalid LISTEN_FDS -1")},
+		{pid, "two", 0, errors.New("Invalid LISTEN_FDS two")},
+	}
+	for _, test := range tests {
+		n, err := ftp_activation.ListenFDs(test.pid, test.fds)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if n != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", n, test.expected)
+		}
+	}
+}
+
+func TestListenersWithoutActivation(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	listeners, err := ftp_activation.Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Error actual = %v %v, and Expected = %v.", listeners, err, nil)
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	conn := ftp_activation.NewPipeConn(inR, outW)
+
+	go inW.Write([]byte("USER demo\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "USER demo\r\n" {
+		t.Errorf("Error actual = %q, and Expected = %q.", line, "USER demo\r\n")
+	}
+	go conn.Write([]byte("331 Password required.\r\n"))
+	line, err = bufio.NewReader(outR).ReadString('\n')
+	if err != nil || line != "331 Password required.\r\n" {
+		t.Errorf("Error actual = %q, and Expected = %q.", line, "331 Password required.\r\n")
+	}
+	if addr := conn.RemoteAddr().Network(); addr != "pipe" {
+		t.Errorf("Error actual = %v, and Expected = %v.", addr, "pipe")
+	}
+	conn.Close()
+	if _, err := outR.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, io.EOF)
+	}
+}
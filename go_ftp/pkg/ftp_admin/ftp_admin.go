@@ -0,0 +1,131 @@
+package ftp_admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Session is an active session as reported by the API.
+type Session struct {
+	ID          uint64  `json:"id"`
+	User        string  `json:"user"`
+	RemoteAddr  string  `json:"remote_addr"`
+	Cwd         string  `json:"cwd"`
+	Transfer    string  `json:"transfer,omitempty"`
+	Transferred int64   `json:"transferred"`
+	Size        int64   `json:"size"`
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// Server is the server administrated through the API.
+type Server interface {
+	Sessions() []Session
+	// Disconnect closes the session with the given id and reports whether it existed.
+	Disconnect(id uint64) bool
+	// DisconnectUser closes all sessions of user and returns the number of closed sessions.
+	DisconnectUser(user string) int
+	SetMaintenance(enabled bool)
+	Maintenance() bool
+}
+
+type handler struct {
+	server Server
+	token  string
+}
+
+type maintenance struct {
+	Enabled bool `json:"enabled"`
+}
+
+type disconnected struct {
+	Disconnected int `json:"disconnected"`
+}
+
+// NewHandler returns the HTTP handler of the admin API:
+//
+//	GET    /sessions[?user=name]  lists the active sessions.
+//	DELETE /sessions/{id}         disconnects a session.
+//	DELETE /sessions?user=name    disconnects all sessions of a user.
+//	GET    /maintenance           reports whether maintenance mode is enabled.
+//	PUT    /maintenance           enables or disables maintenance mode, body {"enabled": true}.
+//
+// Requests must carry token in an "Authorization: Bearer" header, all requests are refused if it's empty.
+func NewHandler(server Server, token string) http.Handler {
+	return &handler{server: server, token: token}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := []byte(r.Header.Get("Authorization"))
+	if h.token == "" || subtle.ConstantTimeCompare(auth, []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "sessions" && r.Method == http.MethodGet:
+		h.listSessions(w, r)
+	case path == "sessions" && r.Method == http.MethodDelete:
+		h.disconnectUser(w, r)
+	case strings.HasPrefix(path, "sessions/") && r.Method == http.MethodDelete:
+		h.disconnect(w, strings.TrimPrefix(path, "sessions/"))
+	case path == "maintenance" && r.Method == http.MethodGet:
+		writeJSON(w, maintenance{h.server.Maintenance()})
+	case path == "maintenance" && r.Method == http.MethodPut:
+		h.setMaintenance(w, r)
+	case path == "sessions" || strings.HasPrefix(path, "sessions/") || path == "maintenance":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	sessions := []Session{}
+	for _, session := range h.server.Sessions() {
+		if user == "" || session.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+	writeJSON(w, sessions)
+}
+
+func (h *handler) disconnect(w http.ResponseWriter, idStr string) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+	if !h.server.Disconnect(id) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, disconnected{1})
+}
+
+func (h *handler) disconnectUser(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "Missing user", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, disconnected{h.server.DisconnectUser(user)})
+}
+
+func (h *handler) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var m maintenance
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	h.server.SetMaintenance(m.Enabled)
+	writeJSON(w, m)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,103 @@
+package ftp_admin_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_admin"
+)
+
+type fakeServer struct {
+	sessions    []ftp_admin.Session
+	maintenance bool
+}
+
+func (s *fakeServer) Sessions() []ftp_admin.Session {
+	return s.sessions
+}
+
+func (s *fakeServer) Disconnect(id uint64) bool {
+	for i, session := range s.sessions {
+		if session.ID == id {
+			s.sessions = append(s.sessions[:i], s.sessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeServer) DisconnectUser(user string) int {
+	var kept []ftp_admin.Session
+	for _, session := range s.sessions {
+		if session.User != user {
+			kept = append(kept, session)
+		}
+	}
+	n := len(s.sessions) - len(kept)
+	s.sessions = kept
+	return n
+}
+
+func (s *fakeServer) SetMaintenance(enabled bool) {
+	s.maintenance = enabled
+}
+
+func (s *fakeServer) Maintenance() bool {
+	return s.maintenance
+}
+
+func TestHandler(t *testing.T) {
+	server := &fakeServer{sessions: []ftp_admin.Session{
+		{ID: 1, User: "demo", RemoteAddr: "127.0.0.1:5000", Cwd: "/", Size: -1},
+		{ID: 2, User: "demo", RemoteAddr: "127.0.0.1:5001", Cwd: "/1", Transfer: "RETR a", Transferred: 5, Size: 10},
+		{ID: 3, User: "other", RemoteAddr: "127.0.0.1:5002", Cwd: "/", Size: -1},
+	}}
+	handler := ftp_admin.NewHandler(server, "secret")
+
+	var tests = []struct {
+		method   string
+		url      string
+		body     string
+		token    string
+		code     int
+		expected string
+	}{
+		{"GET", "/sessions", "", "", 401, "Unauthorized\n"},
+		{"GET", "/sessions", "", "wrong", 401, "Unauthorized\n"},
+		{"GET", "/sessions?user=other", "", "secret", 200,
+			`[{"id":3,"user":"other","remote_addr":"127.0.0.1:5002","cwd":"/","transferred":0,"size":-1,"idle_seconds":0}]` + "\n"},
+		{"DELETE", "/sessions/1", "", "secret", 200, `{"disconnected":1}` + "\n"},
+		{"DELETE", "/sessions/1", "", "secret", 404, "Session not found\n"},
+		{"DELETE", "/sessions/x", "", "secret", 400, "Invalid session id\n"},
+		{"DELETE", "/sessions?user=demo", "", "secret", 200, `{"disconnected":1}` + "\n"},
+		{"DELETE", "/sessions", "", "secret", 400, "Missing user\n"},
+		{"GET", "/sessions?user=demo", "", "secret", 200, "[]\n"},
+		{"PUT", "/maintenance", `{"enabled":true}`, "secret", 200, `{"enabled":true}` + "\n"},
+		{"GET", "/maintenance", "", "secret", 200, `{"enabled":true}` + "\n"},
+		{"POST", "/maintenance", "", "secret", 405, "Method not allowed\n"},
+		{"GET", "/unknown", "", "secret", 404, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Error actual = %v, and Expected = %v.", rec.Code, test.code)
+		}
+		if rec.Body.String() != test.expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", rec.Body.String(), test.expected)
+		}
+	}
+	if !server.maintenance {
+		t.Errorf("Error actual = %v, and Expected = %v.", server.maintenance, true)
+	}
+	rec := httptest.NewRecorder()
+	ftp_admin.NewHandler(server, "").ServeHTTP(rec, httptest.NewRequest("GET", "/sessions", nil))
+	if rec.Code != 401 {
+		t.Errorf("Error actual = %v, and Expected = %v.", rec.Code, 401)
+	}
+}
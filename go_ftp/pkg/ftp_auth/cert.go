@@ -0,0 +1,106 @@
+package ftp_auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CertRule maps client certificates to a user. Field selects what is matched: "cn" the common name of the
+// subject, "subject" the whole subject, or one of the SANs "dns", "email" and "uri". Pattern is matched with
+// path.Match, e.g. "*.example.com". If User is empty the matched value is used as user name.
+type CertRule struct {
+	Field   string
+	Pattern string
+	User    string
+}
+
+// CertMapper maps verified client certificates to users.
+type CertMapper struct {
+	roots *x509.CertPool
+	rules []CertRule
+}
+
+// ParseCertRule parses a rule written as "field:pattern" or "field:pattern=user", e.g.
+// "cn:backup-*=backup".
+func ParseCertRule(s string) (CertRule, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return CertRule{}, fmt.Errorf("Invalid certificate rule %s", s)
+	}
+	rule := CertRule{Field: strings.ToLower(parts[0]), Pattern: parts[1]}
+	if i := strings.LastIndex(rule.Pattern, "="); i >= 0 {
+		rule.Pattern, rule.User = rule.Pattern[:i], rule.Pattern[i+1:]
+	}
+	switch rule.Field {
+	case "cn", "subject", "dns", "email", "uri":
+	default:
+		return CertRule{}, fmt.Errorf("Unknown certificate field %s", parts[0])
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+		return CertRule{}, fmt.Errorf("Invalid certificate pattern %s", rule.Pattern)
+	}
+	return rule, nil
+}
+
+// NewCertMapper returns a mapper that accepts certificates issued by roots and maps them with the first
+// matching rule.
+func NewCertMapper(roots *x509.CertPool, rules ...CertRule) *CertMapper {
+	return &CertMapper{roots, rules}
+}
+
+// User verifies the certificate chain presented by a client, leaf first, and returns the user it maps to.
+func (m *CertMapper) User(certs []*x509.Certificate) (string, error) {
+	if len(certs) == 0 {
+		return "", errors.New("No client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         m.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range m.rules {
+		for _, value := range certValues(leaf, rule.Field) {
+			if ok, _ := path.Match(rule.Pattern, value); !ok || value == "" {
+				continue
+			}
+			if rule.User != "" {
+				return rule.User, nil
+			}
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("No user for certificate %s", leaf.Subject)
+}
+
+// Private Methods
+
+func certValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "cn":
+		return []string{cert.Subject.CommonName}
+	case "subject":
+		return []string{cert.Subject.String()}
+	case "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		values := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+		return values
+	}
+	return nil
+}
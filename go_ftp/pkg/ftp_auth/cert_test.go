@@ -0,0 +1,111 @@
+package ftp_auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func newCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestParseCertRule(t *testing.T) {
+	var tests = []struct {
+		input       string
+		expected    ftp_auth.CertRule
+		expectedErr error
+	}{
+		{"cn:backup-*=backup", ftp_auth.CertRule{Field: "cn", Pattern: "backup-*", User: "backup"}, nil},
+		{"DNS:*.example.com", ftp_auth.CertRule{Field: "dns", Pattern: "*.example.com"}, nil},
+		{"ip:127.0.0.1", ftp_auth.CertRule{}, errors.New("Unknown certificate field ip")},
+		{"cn", ftp_auth.CertRule{}, errors.New("Invalid certificate rule cn")},
+		{"cn:[=user", ftp_auth.CertRule{}, errors.New("Invalid certificate pattern [")},
+	}
+	for _, test := range tests {
+		rule, err := ftp_auth.ParseCertRule(test.input)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if rule != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", rule, test.expected)
+		}
+	}
+}
+
+func TestCertMapper(t *testing.T) {
+	ca, caKey := newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client := func(serial int64, cn string, dns ...string) *x509.Certificate {
+		cert, _ := newCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     dns,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}, ca, caKey)
+		return cert
+	}
+	other, _ := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(9),
+		Subject:      pkix.Name{CommonName: "backup-1"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	mapper := ftp_auth.NewCertMapper(pool,
+		ftp_auth.CertRule{Field: "cn", Pattern: "backup-*", User: "backup"},
+		ftp_auth.CertRule{Field: "dns", Pattern: "*.example.com"})
+	var tests = []struct {
+		certs       []*x509.Certificate
+		expected    string
+		expectedErr error
+	}{
+		{[]*x509.Certificate{client(2, "backup-1")}, "backup", nil},
+		{[]*x509.Certificate{client(3, "app", "other.org", "app.example.com")}, "app.example.com", nil},
+		{[]*x509.Certificate{client(4, "app")}, "", errors.New("No user for certificate CN=app")},
+		{[]*x509.Certificate{other}, "", errors.New("x509: certificate signed by unknown authority")},
+		{nil, "", errors.New("No client certificate")},
+	}
+	for _, test := range tests {
+		user, err := mapper.User(test.certs)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if user != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", user, test.expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package ftp_auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is sent to external authenticators as JSON.
+type Request struct {
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	RemoteAddr string `json:"remote_addr"`
+	// Host is the virtual host selected with HOST, or empty for the default host.
+	Host string `json:"host,omitempty"`
+	// Certificate is set if the user was verified by a TLS client certificate, Password is empty then.
+	Certificate bool `json:"certificate,omitempty"`
+}
+
+// Response is the JSON answer of external authenticators.
+type Response struct {
+	Allow bool `json:"allow"`
+	// Home is the root directory of the session, relative paths are relative to the root of the server. The
+	// root of the server is used if it's empty.
+	Home string `json:"home,omitempty"`
+	// Permissions is "r" for read-only access, or "rw", which is the default.
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// ReadOnly reports whether the permissions of r deny changes.
+func (r Response) ReadOnly() bool {
+	return r.Permissions != "" && !strings.Contains(r.Permissions, "w")
+}
+
+// Authenticator decides whether a login is allowed. An error means that no decision could be made, e.g.
+// because the identity service is down, and the login is refused.
+type Authenticator interface {
+	Authenticate(req Request) (Response, error)
+}
+
+// NewHTTP returns an authenticator that POSTs the request to url. The service answers with 200 and a
+// Response, or with 401 or 403 to deny the login.
+func NewHTTP(url string, timeout time.Duration) Authenticator {
+	return &httpAuthenticator{url, &http.Client{Timeout: timeout}}
+}
+
+// NewCommand returns an authenticator that runs the program name with args for every login. The program
+// reads the request from stdin and writes the response to stdout, a non-zero exit status denies the login.
+func NewCommand(timeout time.Duration, name string, args ...string) Authenticator {
+	return &commandAuthenticator{name, args, timeout}
+}
+
+// NewCache returns an authenticator that remembers the responses of auth that allow the login for ttl, so
+// that clients that log in repeatedly don't hit the identity service every time. Denials and errors aren't
+// cached, so that a user who was just added or whose password was just changed can log in at once.
+// Passwords are only kept hashed.
+func NewCache(auth Authenticator, ttl time.Duration) Authenticator {
+	return &cache{auth: auth, ttl: ttl, entries: make(map[[sha256.Size]byte]cacheEntry)}
+}
+
+// Private Methods
+
+type httpAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func (a *httpAuthenticator) Authenticate(req Request) (Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Response{}, nil
+	default:
+		return Response{}, fmt.Errorf("Authentication service returned status %d", resp.StatusCode)
+	}
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Response{}, fmt.Errorf("Invalid response from authentication service: %s", err)
+	}
+	return response, nil
+}
+
+type commandAuthenticator struct {
+	name    string
+	args    []string
+	timeout time.Duration
+}
+
+func (a *commandAuthenticator) Authenticate(req Request) (Response, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.name, a.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return Response{}, fmt.Errorf("Authentication command timed out after %s", a.timeout)
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return Response{}, nil
+	}
+	if err != nil {
+		return Response{}, err
+	}
+	var response Response
+	if err := json.Unmarshal(output, &response); err != nil {
+		return Response{}, fmt.Errorf("Invalid response from authentication command: %s", err)
+	}
+	return response, nil
+}
+
+type cache struct {
+	auth    Authenticator
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cacheEntry
+}
+
+type cacheEntry struct {
+	response Response
+	expires  time.Time
+}
+
+func (c *cache) Authenticate(req Request) (Response, error) {
+	key := cacheKey(req)
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.response, nil
+	}
+	response, err := c.auth.Authenticate(req)
+	if err != nil {
+		return Response{}, err
+	}
+	if !response.Allow {
+		return response, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{response, now.Add(c.ttl)}
+	return response, nil
+}
+
+// cacheKey identifies a request by everything but the port of the client, which changes with every
+// connection.
+func cacheKey(req Request) [sha256.Size]byte {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	fields := []string{req.User, req.Password, req.Host, ip, fmt.Sprint(req.Certificate)}
+	return sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+}
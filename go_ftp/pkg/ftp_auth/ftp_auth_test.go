@@ -0,0 +1,124 @@
+package ftp_auth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+var authTests = []struct {
+	req         ftp_auth.Request
+	expected    ftp_auth.Response
+	expectedErr error
+}{
+	{ftp_auth.Request{User: "alice", Password: "secret", RemoteAddr: "127.0.0.1:4000"},
+		ftp_auth.Response{Allow: true, Home: "/srv/alice", Permissions: "r"}, nil},
+	{ftp_auth.Request{User: "alice", Password: "wrong", RemoteAddr: "127.0.0.1:4000"}, ftp_auth.Response{}, nil},
+	{ftp_auth.Request{User: "bob", Password: "secret", RemoteAddr: "127.0.0.1:4000"}, ftp_auth.Response{}, nil},
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ftp_auth.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.User == "bob":
+			w.WriteHeader(http.StatusForbidden)
+		case req.Password == "secret":
+			json.NewEncoder(w).Encode(ftp_auth.Response{Allow: true, Home: "/srv/alice", Permissions: "r"})
+		default:
+			json.NewEncoder(w).Encode(ftp_auth.Response{})
+		}
+	}))
+	defer srv.Close()
+	auth := ftp_auth.NewHTTP(srv.URL, time.Second)
+	for _, test := range authTests {
+		resp, err := auth.Authenticate(test.req)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if resp != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", resp, test.expected)
+		}
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	auth = ftp_auth.NewHTTP(missing.URL, time.Second)
+	_, err := auth.Authenticate(authTests[0].req)
+	expectedErr := errors.New("Authentication service returned status 404")
+	if ok, have, want := test_utils.VerifyError(err, expectedErr); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	script := `read req
+case "$req" in
+*'"user":"bob"'*) exit 1 ;;
+*'"password":"secret"'*) echo '{"allow":true,"home":"/srv/alice","permissions":"r"}' ;;
+*) echo '{"allow":false}' ;;
+esac`
+	auth := ftp_auth.NewCommand(time.Second, "sh", "-c", script)
+	for _, test := range authTests {
+		resp, err := auth.Authenticate(test.req)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if resp != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", resp, test.expected)
+		}
+	}
+
+	auth = ftp_auth.NewCommand(100*time.Millisecond, "sleep", "1")
+	_, err := auth.Authenticate(authTests[0].req)
+	expectedErr := errors.New("Authentication command timed out after 100ms")
+	if ok, have, want := test_utils.VerifyError(err, expectedErr); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+}
+
+type countingAuthenticator struct {
+	calls int
+}
+
+func (a *countingAuthenticator) Authenticate(req ftp_auth.Request) (ftp_auth.Response, error) {
+	a.calls++
+	return ftp_auth.Response{Allow: req.Password == "secret"}, nil
+}
+
+func TestCache(t *testing.T) {
+	counter := &countingAuthenticator{}
+	auth := ftp_auth.NewCache(counter, time.Hour)
+	var tests = []struct {
+		req           ftp_auth.Request
+		expectedAllow bool
+		expectedCalls int
+	}{
+		{ftp_auth.Request{User: "alice", Password: "secret", RemoteAddr: "127.0.0.1:4000"}, true, 1},
+		{ftp_auth.Request{User: "alice", Password: "secret", RemoteAddr: "127.0.0.1:4001"}, true, 1},
+		{ftp_auth.Request{User: "alice", Password: "wrong", RemoteAddr: "127.0.0.1:4002"}, false, 2},
+		// Denials aren't cached.
+		{ftp_auth.Request{User: "alice", Password: "wrong", RemoteAddr: "127.0.0.1:4003"}, false, 3},
+		{ftp_auth.Request{User: "alice", Password: "secret", RemoteAddr: "127.0.0.2:4000"}, true, 4},
+		{ftp_auth.Request{User: "alice", Password: "secret", RemoteAddr: "127.0.0.1:4004", Host: "a"}, true, 5},
+	}
+	for _, test := range tests {
+		resp, err := auth.Authenticate(test.req)
+		if err != nil || resp.Allow != test.expectedAllow {
+			t.Errorf("Error actual = %v, and Expected = %v.", resp.Allow, test.expectedAllow)
+		}
+		if counter.calls != test.expectedCalls {
+			t.Errorf("Error actual = %v, and Expected = %v.", counter.calls, test.expectedCalls)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package ftp_charset
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// Lookup returns the charset with the given IANA name or alias, e.g. "ISO-8859-1", "latin1" or
+// "windows-1252".
+func Lookup(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("Unsupported charset %s", name)
+	}
+	return enc, nil
+}
+
+// Decode converts a path received from the other side to UTF-8 in normalization form C, so that names typed
+// on systems that decompose characters, e.g. macOS, refer to the same files. Arguments that aren't valid
+// UTF-8 are decoded from fallback, or rejected with an ftp_error.InvalidEncodingError if fallback is nil.
+func Decode(s string, fallback encoding.Encoding) (string, error) {
+	if !utf8.ValidString(s) {
+		if fallback == nil {
+			return "", &ftp_error.InvalidEncodingError{Arg: s}
+		}
+		decoded, err := fallback.NewDecoder().String(s)
+		if err != nil {
+			return "", &ftp_error.InvalidEncodingError{Arg: s}
+		}
+		s = decoded
+	}
+	return norm.NFC.String(s), nil
+}
+
+// Encode converts s to enc for sending to the other side, characters that enc can't represent are replaced.
+// A nil enc means UTF-8.
+func Encode(s string, enc encoding.Encoding) string {
+	if enc == nil {
+		return s
+	}
+	encoded, err := encoding.ReplaceUnsupported(enc.NewEncoder()).String(s)
+	if err != nil {
+		return s
+	}
+	return encoded
+}
@@ -0,0 +1,64 @@
+package ftp_charset_test
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func TestDecode(t *testing.T) {
+	var tests = []struct {
+		in          string
+		fallback    encoding.Encoding
+		expected    string
+		expectedErr error
+	}{
+		{"räksmörgås.txt", nil, "räksmörgås.txt", nil},
+		{"räksmörgås.txt", nil, "räksmörgås.txt", nil},
+		{"r\xe4ksm\xf6rg\xe5s.txt", charmap.ISO8859_1, "räksmörgås.txt", nil},
+		{"räksmörgås.txt", charmap.ISO8859_1, "räksmörgås.txt", nil},
+		{"r\xe4ksm\xf6rg\xe5s.txt", nil, "", errors.New("Invalid encoding of \"r\\xe4ksm\\xf6rg\\xe5s.txt\"")},
+	}
+	for _, test := range tests {
+		out, err := ftp_charset.Decode(test.in, test.fallback)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if out != test.expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", out, test.expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	var tests = []struct {
+		in       string
+		enc      encoding.Encoding
+		expected string
+	}{
+		{"räksmörgås.txt", nil, "räksmörgås.txt"},
+		{"räksmörgås.txt", charmap.ISO8859_1, "r\xe4ksm\xf6rg\xe5s.txt"},
+		{"€.txt", charmap.ISO8859_1, "\x1a.txt"},
+	}
+	for _, test := range tests {
+		if out := ftp_charset.Encode(test.in, test.enc); out != test.expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", out, test.expected)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"ISO-8859-1", "latin1", "windows-1252"} {
+		if _, err := ftp_charset.Lookup(name); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+	}
+	if _, err := ftp_charset.Lookup("klingon"); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "Unsupported charset klingon")
+	}
+}
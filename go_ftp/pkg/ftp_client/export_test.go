@@ -0,0 +1,12 @@
+package ftp_client
+
+// VerifyDownload exposes verifyDownload to the tests. The messages it prints are discarded, the client
+// can't process commands afterwards.
+func (client *FtpClient) VerifyDownload(arg string) error {
+	go func() {
+		for range client.ioCh {
+		}
+	}()
+	defer close(client.ioCh)
+	return client.verifyDownload(arg)
+}
@@ -2,18 +2,24 @@ package ftp_client
 
 import (
 	"bufio"
+	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 
+	"golang.org/x/text/encoding"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hash"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
 )
 
@@ -25,6 +31,19 @@ type FtpClient struct {
 	dataConnAddr    string
 	outDir          string
 	ioCh            chan string
+	verify          bool
+	compress        bool
+	utf8            bool
+	charset         encoding.Encoding
+	host            string
+}
+
+// dataConnection is the address, mode and compression of a data connection at the time of its transfer
+// command.
+type dataConnection struct {
+	addr     string
+	mode     ftp_cmd.MODE
+	compress bool
 }
 
 // Public Methods
@@ -64,7 +83,7 @@ Loop:
 		if err != nil {
 			log.Printf("%s.\n", err.Error())
 			switch err.(type) {
-			case *ftp_error.NoArgumentError, *ftp_error.InvalidCommandError:
+			case *ftp_error.NoArgumentError, *ftp_error.InvalidCommandError, *ftp_error.LineTooLongError:
 				continue
 			default:
 				break Loop
@@ -86,7 +105,83 @@ Loop:
 	return nil
 }
 
+// SetVerify enables verification of downloaded files against the hash reported by the server.
+func (client *FtpClient) SetVerify(verify bool) {
+	client.verify = verify
+}
+
+// EnableCompression switches to MODE Z if the server advertises it in its FEAT reply.
+// It returns whether compression is used.
+func (client *FtpClient) EnableCompression() (bool, error) {
+	status, reply, err := client.processCommand(&ftp_cmd.Cmd{Type: ftp_cmd.FEAT}, nil)
+	if err != nil {
+		return false, err
+	}
+	if status != 211 || !hasFeature(reply, "MODE Z") {
+		return false, nil
+	}
+	status, _, err = client.processCommand(&ftp_cmd.Cmd{Type: ftp_cmd.MODE_CMD, Arg: "Z"}, nil)
+	if err != nil {
+		return false, err
+	}
+	if status != 200 {
+		return false, nil
+	}
+	client.compress = true
+	return true, nil
+}
+
+// SetFallbackCharset sets the charset, e.g. ISO-8859-1, used for file names if the server doesn't support
+// UTF-8. By default file names are sent as UTF-8.
+func (client *FtpClient) SetFallbackCharset(charset encoding.Encoding) {
+	client.charset = charset
+}
+
+// EnableUTF8 sends "OPTS UTF8 ON" if the server advertises UTF8 in its FEAT reply. It returns whether the
+// server accepted UTF-8, otherwise file names are sent in the fallback charset, or as is if there is none.
+func (client *FtpClient) EnableUTF8() (bool, error) {
+	status, reply, err := client.processCommand(&ftp_cmd.Cmd{Type: ftp_cmd.FEAT}, nil)
+	if err != nil {
+		return false, err
+	}
+	if status != 211 || !hasFeature(reply, "UTF8") {
+		return false, nil
+	}
+	status, _, err = client.command(ftp_cmd.OPTS, "UTF8 ON")
+	if err != nil {
+		return false, err
+	}
+	client.utf8 = status == 200
+	return client.utf8, nil
+}
+
+// SetHost sets the host name that Authenticate sends with HOST (RFC 7151) to select a virtual host. addr is
+// the address used to connect, "host:port" or just the host. IP addresses don't name a virtual host and are
+// ignored.
+func (client *FtpClient) SetHost(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	client.host = host
+}
+
 func (client *FtpClient) Authenticate(user, pw string) error {
+	// 0. Select the virtual host, servers that don't implement HOST or don't know the host (504) use their
+	// default host
+	if client.host != "" {
+		status, reply, err := client.processCommand(&ftp_cmd.Cmd{Type: ftp_cmd.HOST, Arg: client.host}, nil)
+		if err != nil {
+			return err
+		}
+		if status != 220 && status != 500 && status != 502 && status != 504 {
+			return unexpectedStatusError(status, 220)
+		}
+		log.Printf("HOST %s: %d %s\n", client.host, status, reply)
+	}
 	// 1. Send user using the "USER :user" FTP command
 	status, _, err := client.processCommand(&ftp_cmd.Cmd{ftp_cmd.USER, user}, nil)
 	if err != nil {
@@ -106,6 +201,60 @@ func (client *FtpClient) Authenticate(user, pw string) error {
 	return nil
 }
 
+// TransferTo copies srcPath on the server of client to dstPath on the server of dst using a server to
+// server (FXP) transfer, the data is sent directly between the servers. The user on the source server must
+// be allowed to do FXP transfers to connect to the destination server. The user on the destination server
+// must be allowed to do FXP transfers too, or the destination server must accept passive data connections
+// from any IP (AllowAnyPassiveIP), as the data connection doesn't come from the client.
+func (client *FtpClient) TransferTo(dst *FtpClient, srcPath, dstPath string) error {
+	status, reply, err := dst.command(ftp_cmd.PASV, "")
+	if err != nil {
+		return err
+	}
+	if status != 227 {
+		return transferError(ftp_cmd.PASV, status)
+	}
+	addr, err := ftp_ip.Decode(reply)
+	if err != nil {
+		return err
+	}
+	tmp := strings.Split(addr, ":")
+	encodedAddr, err := ftp_ip.Encode(tmp[0], tmp[1])
+	if err != nil {
+		return err
+	}
+	status, _, err = client.command(ftp_cmd.PORT, encodedAddr)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return transferError(ftp_cmd.PORT, status)
+	}
+	// The destination must be listening before the source connects to it.
+	if status, _, err = dst.command(ftp_cmd.STOR, dstPath); err != nil {
+		return err
+	}
+	if status != 150 {
+		return transferError(ftp_cmd.STOR, status)
+	}
+	if status, _, err = client.command(ftp_cmd.RETR, srcPath); err != nil {
+		return err
+	}
+	if status != 150 {
+		return transferError(ftp_cmd.RETR, status)
+	}
+	for _, c := range []*FtpClient{client, dst} {
+		status, _, err := c.readCtrlConn()
+		if err != nil {
+			return err
+		}
+		if status != 226 {
+			return fmt.Errorf("FXP transfer failed with status %d", status)
+		}
+	}
+	return nil
+}
+
 func (client *FtpClient) ReadWelcomeMessage() (int, string, error) {
 	return client.readCtrlConn()
 }
@@ -114,12 +263,16 @@ func (client *FtpClient) ReadWelcomeMessage() (int, string, error) {
 
 func (client *FtpClient) processCommand(command *ftp_cmd.Cmd, wg *sync.WaitGroup) (int, string, error) {
 	cmd, arg := command.Type, command.Arg
+	done := make(chan error, 1)
 	switch cmd {
 	case ftp_cmd.LIST, ftp_cmd.RETR, ftp_cmd.STOR:
 		if client.connectionMode == ftp_cmd.NOT_SET {
 			return 0, "", errors.New("No connection mode specified")
 		}
-		go client.startDataConnection(cmd, arg, client.dataConnAddr, wg)
+		// The reply to the transfer command resets the connection mode, so the goroutine gets a copy of it.
+		go func(dc dataConnection) {
+			done <- client.startDataConnection(cmd, arg, dc, wg)
+		}(dataConnection{client.dataConnAddr, client.connectionMode, client.compress})
 	case ftp_cmd.PORT:
 		tmp := strings.Split(arg, ":")
 		encodedArg, err := ftp_ip.Encode(tmp[0], tmp[1])
@@ -138,10 +291,54 @@ func (client *FtpClient) processCommand(command *ftp_cmd.Cmd, wg *sync.WaitGroup
 	if _, err := client.send(cmd, arg); err != nil {
 		return 0, "", err
 	}
-	return client.handleReply(cmd)
+	status, reply, err := client.handleReply(cmd, arg)
+	if err == nil && cmd == ftp_cmd.RETR && status == 226 && client.verify {
+		if err := <-done; err != nil {
+			return status, reply, err
+		}
+		return status, reply, client.verifyDownload(arg)
+	}
+	return status, reply, err
+}
+
+func (client *FtpClient) verifyDownload(arg string) error {
+	if _, err := client.send(ftp_cmd.HASH, arg); err != nil {
+		return err
+	}
+	status, reply, err := client.readReply()
+	if err != nil {
+		return err
+	}
+	if status != 213 {
+		return fmt.Errorf("Could not verify %s, server replied %d %s", arg, status, reply)
+	}
+	// The reply has the format "<algorithm> <start>-<end> <hash> <file name>".
+	fields := strings.Fields(reply)
+	if len(fields) < 3 {
+		return fmt.Errorf("Invalid HASH reply %s", reply)
+	}
+	algo, ok := ftp_hash.Parse(fields[0])
+	if !ok {
+		return fmt.Errorf("Unknown hash algorithm %s", fields[0])
+	}
+	file, err := os.Open(client.localPath(arg))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sum, err := ftp_hash.Reader(file, algo)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, fields[2]) {
+		client.ioCh <- fmt.Sprintf("Checksum mismatch for %s, local %s %s, remote %s.\n", arg, algo, sum, fields[2])
+		return fmt.Errorf("Checksum mismatch for %s", arg)
+	}
+	client.ioCh <- fmt.Sprintf("Checksum %s %s verified.\n", algo, sum)
+	return nil
 }
 
-func (client *FtpClient) handleReply(cmd ftp_cmd.CmdType) (int, string, error) {
+func (client *FtpClient) handleReply(cmd ftp_cmd.CmdType, arg string) (int, string, error) {
 	status, reply, err := client.readReply()
 	if err != nil {
 		return 0, "", err
@@ -156,6 +353,10 @@ func (client *FtpClient) handleReply(cmd ftp_cmd.CmdType) (int, string, error) {
 		client.connectionMode = ftp_cmd.PASSIVE
 	case ftp_cmd.QUIT:
 		return status, reply, &ftp_error.ExitError{}
+	case ftp_cmd.MODE_CMD:
+		if status == 200 {
+			client.compress = strings.ToUpper(arg) == "Z"
+		}
 	case ftp_cmd.PORT:
 		client.connectionMode = ftp_cmd.ACTIVE
 	default:
@@ -163,14 +364,14 @@ func (client *FtpClient) handleReply(cmd ftp_cmd.CmdType) (int, string, error) {
 	return status, reply, nil
 }
 
-func (client *FtpClient) startDataConnection(cmd ftp_cmd.CmdType, arg, addr string, wg *sync.WaitGroup) error {
+func (client *FtpClient) startDataConnection(cmd ftp_cmd.CmdType, arg string, dc dataConnection, wg *sync.WaitGroup) error {
 	wg.Add(1)
-	log.Printf("Starting data channel on addr %s.\n", addr)
+	log.Printf("Starting data channel on addr %s.\n", dc.addr)
 	dataAction, err := getDataAction(cmd)
 	if err != nil {
 		return err
 	}
-	replyCh, err := client.openDataConnection(addr, dataAction)
+	replyCh, err := client.openDataConnection(dc, dataAction)
 	if err != nil {
 		return err
 	}
@@ -188,6 +389,7 @@ func (client *FtpClient) startDataConnection(cmd ftp_cmd.CmdType, arg, addr stri
 	case 'w':
 		bytes, err := ioutil.ReadFile(arg)
 		if err != nil {
+			close(replyCh)
 			return err
 		}
 		replyCh <- bytes
@@ -196,80 +398,118 @@ func (client *FtpClient) startDataConnection(cmd ftp_cmd.CmdType, arg, addr stri
 
 	switch cmd {
 	case ftp_cmd.LIST:
-		client.ioCh <- fmt.Sprintf(string(buf))
+		client.ioCh <- client.decode(string(buf))
 	case ftp_cmd.RETR:
-		pathComponents := strings.Split(arg, "/")
-		name := pathComponents[len(pathComponents)-1]
-		err = ioutil.WriteFile(client.outDir+name, buf, 0644)
+		err = ioutil.WriteFile(client.localPath(arg), buf, 0644)
 	case ftp_cmd.STOR:
 		client.ioCh <- fmt.Sprintf("File %s saved to server.\n", arg)
 	default:
 		return errors.New("Unknown command")
 	}
 	wg.Done()
-	return nil
+	return err
+}
+
+// localPath returns the path a file downloaded from the server is saved to.
+func (client *FtpClient) localPath(arg string) string {
+	pathComponents := strings.Split(arg, "/")
+	return client.outDir + pathComponents[len(pathComponents)-1]
 }
 
-func (client *FtpClient) openDataConnection(addr string, mode byte) (chan []byte, error) {
-	conn, err := client.getDataConnection(addr)
+func (client *FtpClient) openDataConnection(dc dataConnection, mode byte) (chan []byte, error) {
+	conn, err := getDataConnection(dc)
 	if err != nil {
 		return nil, err
 	}
 	switch mode {
 	case 'r':
-		return readDataAsync(conn), nil
+		return readDataAsync(conn, dc.compress), nil
 	case 'w':
-		return writeDataAsync(conn), nil
+		return writeDataAsync(conn, dc.compress), nil
 	default:
 		return nil, fmt.Errorf("Invalid mode %c", mode)
 	}
 }
 
+// readCtrlConn reads a reply from the server. The lines of a multiline reply are joined by newlines.
 func (client *FtpClient) readCtrlConn() (int, string, error) {
 	if !client.ctrlConnScanner.Scan() {
 		return 0, "", errors.New("Server connection closed")
 	}
-	line := strings.SplitN(client.ctrlConnScanner.Text(), " ", 2)
-	status, err := strconv.Atoi(line[0])
+	line := client.ctrlConnScanner.Text()
+	if len(line) < 4 {
+		return 0, "", fmt.Errorf("Invalid reply %s", line)
+	}
+	status, err := strconv.Atoi(line[:3])
 	if err != nil {
 		return 0, "", err
 	}
-	log.Printf("Reading from srv %d %s.\n", status, line[1])
-	return status, line[1], nil
+	reply := client.decode(line[4:])
+	if line[3] == '-' {
+		for client.ctrlConnScanner.Scan() {
+			line = client.decode(client.ctrlConnScanner.Text())
+			if strings.HasPrefix(line, strconv.Itoa(status)+" ") {
+				reply += "\n" + line[4:]
+				break
+			}
+			reply += "\n" + line
+		}
+	}
+	log.Printf("Reading from srv %d %s.\n", status, reply)
+	return status, reply, nil
 }
 
-func readDataAsync(r net.Conn) chan []byte {
+// readDataAsync reads from r until EOF, the data is decompressed if compressed is set.
+func readDataAsync(r net.Conn, compressed bool) chan []byte {
 	ch := make(chan []byte)
 	go func() {
+		defer close(ch)
+		defer r.Close()
+		var in io.Reader = r
+		if compressed {
+			zr, err := zlib.NewReader(r)
+			if err != nil {
+				log.Println("read error:", err)
+				return
+			}
+			defer zr.Close()
+			in = zr
+		}
 		for {
 			tmp := make([]byte, 256)
-			n, err := r.Read(tmp)
+			n, err := in.Read(tmp)
+			if n > 0 {
+				ch <- tmp[:n]
+			}
 			if err != nil {
 				if err != io.EOF {
 					log.Println("read error:", err)
 				}
-				close(ch)
-				r.Close()
 				return
 			}
-			ch <- tmp[:n]
 		}
 	}()
 	return ch
 }
 
-func writeDataAsync(r net.Conn) chan []byte {
+// writeDataAsync writes everything sent on the returned channel to r, the data is compressed if compressed
+// is set. The connection is closed when the channel is closed.
+func writeDataAsync(r net.Conn, compressed bool) chan []byte {
 	ch := make(chan []byte)
 	go func() {
-		for {
-			for d := range ch {
-				_, err := r.Write(d)
-				if err != nil {
-					log.Println(err.Error())
-					return
-				}
+		defer r.Close()
+		var out io.Writer = r
+		if compressed {
+			zw := zlib.NewWriter(r)
+			defer zw.Close()
+			out = zw
+		}
+		for d := range ch {
+			_, err := out.Write(d)
+			if err != nil {
+				log.Println(err.Error())
+				return
 			}
-			r.Close()
 		}
 	}()
 	return ch
@@ -292,32 +532,71 @@ func (client *FtpClient) readReply() (int, string, error) {
 	return status, reply, err
 }
 
-func (client *FtpClient) getDataConnection(addr string) (net.Conn, error) {
+func getDataConnection(dc dataConnection) (net.Conn, error) {
 	var conn net.Conn
 	var err error
-	switch client.connectionMode {
+	switch dc.mode {
 	case ftp_cmd.ACTIVE:
-		ln, err := net.Listen("tcp", addr)
+		ln, err := net.Listen("tcp", dc.addr)
 		if err != nil {
 			return nil, err
 		}
 		conn, err = ln.Accept()
 	case ftp_cmd.PASSIVE:
-		conn, err = net.Dial("tcp", addr)
+		conn, err = net.Dial("tcp", dc.addr)
 	default:
 		return nil, errors.New("Unknown connection mode")
 	}
 	return conn, err
 }
 
+// command sends cmd without starting any data transfer and reads the first reply.
+func (client *FtpClient) command(cmd ftp_cmd.CmdType, arg string) (int, string, error) {
+	if _, err := client.send(cmd, arg); err != nil {
+		return 0, "", err
+	}
+	return client.readCtrlConn()
+}
+
 func (client *FtpClient) send(cmd ftp_cmd.CmdType, args string) (int, error) {
-	return fmt.Fprintf(client.ctrlConn, string(cmd)+" "+args+"\r\n")
+	args = ftp_charset.Encode(args, client.legacyCharset())
+	return fmt.Fprintf(client.ctrlConn, "%s %s\r\n", cmd, args)
+}
+
+// legacyCharset returns the charset used with the server, or nil for UTF-8.
+func (client *FtpClient) legacyCharset() encoding.Encoding {
+	if client.utf8 {
+		return nil
+	}
+	return client.charset
+}
+
+// decode converts text received from the server to UTF-8, text that can't be decoded is returned as is.
+func (client *FtpClient) decode(text string) string {
+	if decoded, err := ftp_charset.Decode(text, client.legacyCharset()); err == nil {
+		return decoded
+	}
+	return text
+}
+
+// hasFeature reports whether feature is one of the lines of a FEAT reply.
+func hasFeature(reply, feature string) bool {
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), feature) {
+			return true
+		}
+	}
+	return false
 }
 
 func unexpectedStatusError(received, expected int) error {
 	return fmt.Errorf("Expected status code %d when sending user to server but received status %d", expected, received)
 }
 
+func transferError(cmd ftp_cmd.CmdType, status int) error {
+	return fmt.Errorf("FXP transfer failed, %s returned status %d", cmd, status)
+}
+
 func getDataAction(cmd ftp_cmd.CmdType) (byte, error) {
 	switch cmd {
 	case ftp_cmd.RETR, ftp_cmd.LIST:
@@ -1,20 +1,27 @@
 package ftp_client_test
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_client"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_totp"
 	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
 )
 
 func TestFTPClientAuth(t *testing.T) {
-	srv := startFTPServer("/tmp", "127.0.0.1", "8999")
+	srv := startFTPServer("/tmp", "127.0.0.1", "8999", nil)
 	client, conn := startFTPClient("/tmp")
 	defer conn.Close()
 
@@ -37,8 +44,393 @@ func TestFTPClientAuth(t *testing.T) {
 	srv.Stop()
 }
 
-func startFTPServer(root, ip, port string) *ftp_server.FtpServer {
+func TestTransfer(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := startFTPServer(root, "127.0.0.1", "8999", nil)
+	client, conn := startFTPClient(root)
+	defer conn.Close()
+	if err := client.Authenticate("demo", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("line\r\n")
+	var tests = []struct {
+		setup            string
+		cmd              string
+		upload           []byte
+		expectedData     []byte
+		expectedStatuses []int
+	}{
+		{"PASV", "STOR", content, nil, []int{227, 150, 226}},
+		{"EPSV", "RETR", nil, content, []int{229, 150, 226}},
+		{"PORT", "RETR", nil, content, []int{200, 150, 226}},
+		{"PASV", "DELE", nil, nil, []int{227, 250}},
+		{"PASV", "RETR", nil, nil, []int{227, 550}},
+	}
+	for _, test := range tests {
+		data, replies, err := client.Transfer(test.setup, test.cmd, "file.txt", test.upload, time.Second)
+		if err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+			continue
+		}
+		if !bytes.Equal(data, test.expectedData) {
+			t.Errorf("Error actual = %q, and Expected = %q.", data, test.expectedData)
+		}
+		var statuses []int
+		for _, reply := range replies {
+			statuses = append(statuses, reply.Status)
+		}
+		if !equalStatuses(statuses, test.expectedStatuses) {
+			t.Errorf("Error actual = %v, and Expected = %v.", statuses, test.expectedStatuses)
+		}
+	}
+	srv.Stop()
+}
+
+func TestHost(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	addHost := func(srv *ftp_server.FtpServer) {
+		if err := srv.AddHost("LocalHost", root, map[string]string{"web": "secret"}, "Welcome to localhost."); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loginErr := errors.New("Expected status code 230 when sending user to server but received status 530")
+	var tests = []struct {
+		configure   func(srv *ftp_server.FtpServer)
+		addr        string
+		user        string
+		pass        string
+		expectedErr error
+	}{
+		{addHost, "localhost:8999", "web", "secret", nil},
+		{addHost, "localhost:8999", "demo", "password", loginErr},
+		{addHost, "127.0.0.1:8999", "demo", "password", nil},
+		{addHost, "127.0.0.1:8999", "web", "secret", loginErr},
+		// Unknown hosts are refused with 504, the client uses the default host then.
+		{addHost, "example.com:8999", "demo", "password", nil},
+		{nil, "localhost:8999", "demo", "password", nil},
+	}
+	for _, test := range tests {
+		srv := startFTPServer("/tmp", "127.0.0.1", "8999", test.configure)
+		client, conn := startFTPClient(root)
+		client.SetHost(test.addr)
+		err := client.Authenticate(test.user, test.pass)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestTransferTo(t *testing.T) {
+	srcRoot, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcRoot)
+	dstRoot, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstRoot)
+	if err := ioutil.WriteFile(srcRoot+"/file.txt", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The clients connect from another address than the servers, so the data connection doesn't come from
+	// the clients as in an FXP transfer between different hosts.
+	dial := func(addr string) (*ftp_client.FtpClient, net.Conn) {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.3")}}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := ftp_client.New(strings.NewReader(""), conn, "127.0.0.3", dstRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.ReadWelcomeMessage()
+		if err := client.Authenticate("demo", "password"); err != nil {
+			t.Fatal(err)
+		}
+		return client, conn
+	}
+	allowFXP := func(srv *ftp_server.FtpServer) {
+		srv.AllowFXP("demo")
+	}
+	allowAnyPassiveIP := func(srv *ftp_server.FtpServer) {
+		srv.AllowAnyPassiveIP(true)
+	}
+
+	var tests = []struct {
+		src         func(srv *ftp_server.FtpServer)
+		dst         func(srv *ftp_server.FtpServer)
+		expectedErr error
+	}{
+		{allowFXP, allowFXP, nil},
+		{allowFXP, allowAnyPassiveIP, nil},
+		// The source server only connects to other hosts than the client for FXP users.
+		{nil, allowFXP, errors.New("FXP transfer failed, PORT returned status 500")},
+	}
+	for _, test := range tests {
+		src := startFTPServer(srcRoot, "127.0.0.1", "8999", test.src)
+		dst := startFTPServer(dstRoot, "127.0.0.1", "8998", test.dst)
+		srcClient, srcConn := dial("127.0.0.1:8999")
+		dstClient, dstConn := dial("127.0.0.1:8998")
+		err := srcClient.TransferTo(dstClient, "file.txt", "copy.txt")
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if test.expectedErr == nil {
+			data, err := ioutil.ReadFile(dstRoot + "/copy.txt")
+			if err != nil || string(data) != "Hello, World!" {
+				t.Errorf("Error actual = %q %v, and Expected = %q.", data, err, "Hello, World!")
+			}
+		}
+		os.Remove(dstRoot + "/copy.txt")
+		srcConn.Close()
+		dstConn.Close()
+		src.Stop()
+		dst.Stop()
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	secret, err := ftp_totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSecret, err := ftp_totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := startFTPServer("/tmp", "127.0.0.1", "8999", func(srv *ftp_server.FtpServer) {
+		if err := srv.AddHost("localhost", root, map[string]string{"demo": "password"}, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.SetTOTP("", "demo", secret); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.SetTOTP("LocalHost", "demo", hostSecret); err != nil {
+			t.Fatal(err)
+		}
+	})
+	code, err := ftp_totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostCode, err := ftp_totp.Code(hostSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginErr := errors.New("Expected status code 230 when sending user to server but received status 530")
+	var tests = []struct {
+		addr        string
+		pass        string
+		expectedErr error
+	}{
+		{"127.0.0.1:8999", "password", loginErr},
+		{"127.0.0.1:8999", "password000000", loginErr},
+		{"127.0.0.1:8999", "wrong" + code, loginErr},
+		{"127.0.0.1:8999", "password" + code, nil},
+		{"127.0.0.1:8999", "password" + code, loginErr},
+		// The user of the virtual host has its own secret, and its own used codes.
+		{"localhost:8999", "password" + code, loginErr},
+		{"localhost:8999", "password" + hostCode, nil},
+		{"localhost:8999", "password" + hostCode, loginErr},
+	}
+	for _, test := range tests {
+		client, conn := startFTPClient("/tmp")
+		client.SetHost(test.addr)
+		err := client.Authenticate("demo", test.pass)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		conn.Close()
+	}
+	srv.Stop()
+}
+
+func TestEnableCompression(t *testing.T) {
+	var tests = []struct {
+		replies  string
+		expected bool
+		sent     string
+	}{
+		{"211-Features:\n UTF8\n211 End\n", false, "FEAT \r\n"},
+		{"211-Features:\n MODE Z\n211 End\n504 Command not implemented for that parameter.\n", false, "FEAT \r\nMODE Z\r\n"},
+		{"211-Features:\n MODE Z\n211 End\n200 Mode set to Z.\n", true, "FEAT \r\nMODE Z\r\n"},
+		{"500 'FEAT': command not understood.\n", false, "FEAT \r\n"},
+	}
+	for _, test := range tests {
+		client, sent := scriptedFTPClient(test.replies, "")
+		actual, err := client.EnableCompression()
+		if err != nil || actual != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+		if sent.String() != test.sent {
+			t.Errorf("Error actual = %q, and Expected = %q.", sent.String(), test.sent)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	root, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	local, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	if err := ioutil.WriteFile(root+"/download.txt", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(local+"/upload.txt", []byte("Hello, Zlib!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// STOR reads the file to upload relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(local); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	srv := startFTPServer(root, "127.0.0.1", "8999", nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := ftp_client.New(strings.NewReader("PASV\nRETR download.txt\nPASV\nSTOR upload.txt\nQUIT\n"), conn, "127.0.0.1", local+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ReadWelcomeMessage()
+	if err := client.Authenticate("demo", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.EnableCompression(); !ok || err != nil {
+		t.Fatalf("Error actual = %v, and Expected = %v.", err, true)
+	}
+	// The server only accepts and sends compressed data now, so the files are only intact if the client
+	// compressed and decompressed them.
+	if err := client.ProcessCommands(); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+	for path, expected := range map[string]string{local + "/download.txt": "Hello, World!", root + "/upload.txt": "Hello, Zlib!"} {
+		content, err := ioutil.ReadFile(path)
+		if err != nil || string(content) != expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", content, expected)
+		}
+	}
+}
+
+func TestEnableUTF8(t *testing.T) {
+	const login = "331 Password required.\n230 User logged in.\n"
+	var tests = []struct {
+		charset  encoding.Encoding
+		replies  string
+		expected bool
+		sent     string
+	}{
+		{nil, "211-Features:\n MODE Z\n211 End\n" + login, false, "FEAT \r\nUSER j\xc3\xb6rg\r\nPASS pw\r\n"},
+		{charmap.ISO8859_1, "211-Features:\n MODE Z\n211 End\n" + login, false, "FEAT \r\nUSER j\xf6rg\r\nPASS pw\r\n"},
+		{nil, "211-Features:\n UTF8\n211 End\n200 UTF8 set to on.\n" + login, true,
+			"FEAT \r\nOPTS UTF8 ON\r\nUSER j\xc3\xb6rg\r\nPASS pw\r\n"},
+		{charmap.ISO8859_1, "211-Features:\n UTF8\n211 End\n200 UTF8 set to on.\n" + login, true,
+			"FEAT \r\nOPTS UTF8 ON\r\nUSER j\xc3\xb6rg\r\nPASS pw\r\n"},
+		// The fallback charset is used if the server refuses UTF-8 although it advertises it.
+		{charmap.ISO8859_1, "211-Features:\n UTF8\n211 End\n501 Option not understood.\n" + login, false,
+			"FEAT \r\nOPTS UTF8 ON\r\nUSER j\xf6rg\r\nPASS pw\r\n"},
+	}
+	for _, test := range tests {
+		client, sent := scriptedFTPClient(test.replies, "")
+		client.SetFallbackCharset(test.charset)
+		actual, err := client.EnableUTF8()
+		if err != nil || actual != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+		if err := client.Authenticate("j\u00f6rg", "pw"); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+		if sent.String() != test.sent {
+			t.Errorf("Error actual = %q, and Expected = %q.", sent.String(), test.sent)
+		}
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "ftp_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+	if err := ioutil.WriteFile(outDir+"/file.txt", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		reply       string
+		expectedErr error
+	}{
+		{"213 MD5 0-12 65a8e27d8879283831b664bd8b7f0ad4 file.txt\n", nil},
+		{"213 SHA-256 0-12 DFFD6021BB2BD5B0AF676290809EC3A53191DD81C7F70A4B28688A362182986F file.txt\n", nil},
+		{"213 MD5 0-12 d41d8cd98f00b204e9800998ecf8427e file.txt\n", errors.New("Checksum mismatch for file.txt")},
+		{"213 SHA-512 0-12 65a8e27d8879283831b664bd8b7f0ad4 file.txt\n", errors.New("Unknown hash algorithm SHA-512")},
+		{"213 MD5\n", errors.New("Invalid HASH reply MD5")},
+		{"550 File not found.\n", errors.New("Could not verify file.txt, server replied 550 File not found.")},
+	}
+	for _, test := range tests {
+		client, sent := scriptedFTPClient(test.reply, outDir+"/")
+		err := client.VerifyDownload("file.txt")
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if sent.String() != "HASH file.txt\r\n" {
+			t.Errorf("Error actual = %q, and Expected = %q.", sent.String(), "HASH file.txt\r\n")
+		}
+	}
+}
+
+func equalStatuses(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// startFTPServer starts a server, configure is called before it starts if it isn't nil.
+func startFTPServer(root, ip, port string, configure func(srv *ftp_server.FtpServer)) *ftp_server.FtpServer {
 	srv := ftp_server.New(root, ip, port)
+	if configure != nil {
+		configure(srv)
+	}
 	go func() {
 		srv.Start()
 	}()
@@ -59,3 +451,17 @@ func startFTPClient(outDir string) (*ftp_client.FtpClient, net.Conn) {
 	client.ReadWelcomeMessage()
 	return client, conn
 }
+
+// scriptedFTPClient returns a client whose control connection reads the replies and records the commands
+// sent in the returned buffer. Downloads are saved to outDir.
+func scriptedFTPClient(replies, outDir string) (*ftp_client.FtpClient, *bytes.Buffer) {
+	var sent bytes.Buffer
+	client, err := ftp_client.New(strings.NewReader(""), struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(replies), &sent}, "", outDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client, &sent
+}
@@ -0,0 +1,159 @@
+package ftp_client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
+)
+
+// Reply is a reply from the server, the lines of a multiline reply are joined by newlines.
+type Reply struct {
+	Status int
+	Text   string
+}
+
+func (r Reply) String() string {
+	return fmt.Sprintf("%d %s", r.Status, r.Text)
+}
+
+var epsvPort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// Command sends cmd, which doesn't have to be a command known by the client, and reads the reply. Unlike
+// ProcessCommands it sends commands exactly as given and prints nothing, which makes it suitable for
+// scripting and testing servers.
+func (client *FtpClient) Command(cmd, arg string) (Reply, error) {
+	line := cmd
+	if arg != "" {
+		line += " " + arg
+	}
+	if _, err := fmt.Fprintf(client.ctrlConn, "%s\r\n", line); err != nil {
+		return Reply{}, err
+	}
+	return client.ReadReply()
+}
+
+// ReadReply reads the next reply from the server.
+func (client *FtpClient) ReadReply() (Reply, error) {
+	status, text, err := client.readCtrlConn()
+	return Reply{status, text}, err
+}
+
+// Transfer runs the data command cmd, e.g. "RETR", "STOR" or "LIST", over a data connection set up with
+// setup, which is one of "PASV", "EPSV" or "PORT". upload is sent for commands that store files. It returns
+// the data received and all replies, the transfer stops at the first reply that isn't expected.
+func (client *FtpClient) Transfer(setup, cmd, arg string, upload []byte, timeout time.Duration) ([]byte, []Reply, error) {
+	var replies []Reply
+	dial, reply, err := client.setupDataConnection(setup, timeout)
+	if reply.Status != 0 {
+		replies = append(replies, reply)
+	}
+	if err != nil {
+		return nil, replies, err
+	}
+	reply, err = client.Command(cmd, arg)
+	replies = append(replies, reply)
+	if err != nil || reply.Status/100 != 1 {
+		dial(false)
+		return nil, replies, err
+	}
+	conn, err := dial(true)
+	if err != nil {
+		return nil, replies, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	var data []byte
+	if upload != nil {
+		_, err = conn.Write(upload)
+	} else {
+		data, err = ioutil.ReadAll(conn)
+	}
+	conn.Close()
+	if err != nil {
+		return data, replies, err
+	}
+	reply, err = client.ReadReply()
+	replies = append(replies, reply)
+	return data, replies, err
+}
+
+// setupDataConnection sends the PASV, EPSV or PORT command. The returned function returns the data
+// connection, or just cleans up if connect is false.
+func (client *FtpClient) setupDataConnection(setup string, timeout time.Duration) (func(bool) (net.Conn, error), Reply, error) {
+	ctrlConn, ok := client.ctrlConn.(net.Conn)
+	if !ok {
+		return nil, Reply{}, errors.New("The control connection is not a network connection")
+	}
+	host, _, err := net.SplitHostPort(ctrlConn.RemoteAddr().String())
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	switch strings.ToUpper(setup) {
+	case ftp_cmd.PASV, ftp_cmd.EPSV:
+		reply, err := client.Command(setup, "")
+		if err != nil {
+			return nil, reply, err
+		}
+		var addr string
+		switch reply.Status {
+		case 227:
+			addr, err = ftp_ip.Decode(reply.Text)
+		case 229:
+			match := epsvPort.FindStringSubmatch(reply.Text)
+			if match == nil {
+				return nil, reply, fmt.Errorf("Invalid EPSV reply %s", reply)
+			}
+			addr = net.JoinHostPort(host, match[1])
+		default:
+			err = fmt.Errorf("%s failed with reply %s", setup, reply)
+		}
+		if err != nil {
+			return nil, reply, err
+		}
+		return func(connect bool) (net.Conn, error) {
+			if !connect {
+				return nil, nil
+			}
+			return net.DialTimeout("tcp", addr, timeout)
+		}, reply, nil
+	case ftp_cmd.PORT:
+		localHost, _, err := net.SplitHostPort(ctrlConn.LocalAddr().String())
+		if err != nil {
+			return nil, Reply{}, err
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(localHost, "0"))
+		if err != nil {
+			return nil, Reply{}, err
+		}
+		encoded, err := ftp_ip.Encode(localHost, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			ln.Close()
+			return nil, Reply{}, err
+		}
+		reply, err := client.Command(setup, encoded)
+		if err == nil && reply.Status != 200 {
+			err = fmt.Errorf("%s failed with reply %s", setup, reply)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, reply, err
+		}
+		return func(connect bool) (net.Conn, error) {
+			defer ln.Close()
+			if !connect {
+				return nil, nil
+			}
+			ln.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+			return ln.Accept()
+		}, reply, nil
+	default:
+		return nil, Reply{}, fmt.Errorf("Unknown data connection setup %s", setup)
+	}
+}
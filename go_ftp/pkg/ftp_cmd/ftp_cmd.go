@@ -1,60 +1,149 @@
 package ftp_cmd
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
 type CmdType string
 
 const (
-	LIST CmdType = "LIST"
-	USER         = "USER"
-	PASS         = "PASS"
-	RETR         = "RETR"
-	PWD          = "PWD"
-	CWD          = "CWD"
-	PASV         = "PASV"
-	PORT         = "PORT"
-	QUIT         = "QUIT"
-	EPSV         = "EPSV"
-	TYPE         = "TYPE"
-	DELE         = "DELE"
-	STOR         = "STOR"
+	LIST    CmdType = "LIST"
+	USER            = "USER"
+	PASS            = "PASS"
+	RETR            = "RETR"
+	PWD             = "PWD"
+	CWD             = "CWD"
+	PASV            = "PASV"
+	PORT            = "PORT"
+	QUIT            = "QUIT"
+	EPSV            = "EPSV"
+	TYPE            = "TYPE"
+	DELE            = "DELE"
+	STOR            = "STOR"
+	STOU            = "STOU"
+	RNFR            = "RNFR"
+	RNTO            = "RNTO"
+	SITE            = "SITE"
+	FEAT            = "FEAT"
+	OPTS            = "OPTS"
+	HASH            = "HASH"
+	XMD5            = "XMD5"
+	XSHA1           = "XSHA1"
+	XSHA256         = "XSHA256"
+	XCRC            = "XCRC"
+	EPRT            = "EPRT"
+	LANG            = "LANG"
+	HOST            = "HOST"
+	PBSZ            = "PBSZ"
+	PROT            = "PROT"
+	// MODE_CMD is the MODE command, MODE is already used for the data connection mode.
+	MODE_CMD = "MODE"
+)
+
+// Arg tells whether a command takes an argument.
+type Arg int
+
+const (
+	NoArg Arg = iota
+	OptionalArg
+	RequiredArg
 )
 
-var cmds = []CmdType{
-	LIST,
-	USER,
-	PASS,
-	RETR,
-	PWD,
-	CWD,
-	PASV,
-	PORT,
-	QUIT,
-	EPSV,
-	TYPE,
-	DELE,
-	STOR,
+// Spec describes the syntax of a command and when it may be used.
+type Spec struct {
+	Arg Arg
+	// NoAuth commands may be used before logging in.
+	NoAuth bool
+	// Data commands transfer data over a data connection.
+	Data bool
+	// Path commands take a path argument, which is converted to normalized UTF-8 before it is handled.
+	Path bool
 }
 
-func (cmd CmdType) IsDataCMD() bool {
-	switch cmd {
-	case LIST, RETR, STOR:
-		return true
+// builtins are the commands implemented by the server.
+var builtins = map[CmdType]Spec{
+	LIST:     {Data: true},
+	USER:     {Arg: RequiredArg, NoAuth: true},
+	PASS:     {Arg: RequiredArg, NoAuth: true},
+	RETR:     {Arg: RequiredArg, Data: true, Path: true},
+	PWD:      {},
+	CWD:      {Arg: RequiredArg, Path: true},
+	PASV:     {},
+	PORT:     {Arg: RequiredArg},
+	QUIT:     {NoAuth: true},
+	EPSV:     {},
+	TYPE:     {Arg: RequiredArg},
+	DELE:     {Arg: RequiredArg, Path: true},
+	STOR:     {Arg: RequiredArg, Data: true, Path: true},
+	STOU:     {Data: true},
+	RNFR:     {Arg: RequiredArg, Path: true},
+	RNTO:     {Arg: RequiredArg, Path: true},
+	SITE:     {Arg: RequiredArg, Path: true},
+	FEAT:     {NoAuth: true},
+	OPTS:     {Arg: RequiredArg, NoAuth: true},
+	HASH:     {Arg: RequiredArg, Path: true},
+	XMD5:     {Arg: RequiredArg, Path: true},
+	XSHA1:    {Arg: RequiredArg, Path: true},
+	XSHA256:  {Arg: RequiredArg, Path: true},
+	XCRC:     {Arg: RequiredArg, Path: true},
+	EPRT:     {Arg: RequiredArg},
+	MODE_CMD: {Arg: RequiredArg},
+	LANG:     {Arg: OptionalArg, NoAuth: true},
+	HOST:     {Arg: RequiredArg, NoAuth: true},
+	PBSZ:     {Arg: RequiredArg, NoAuth: true},
+	PROT:     {Arg: RequiredArg, NoAuth: true},
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[CmdType]Spec)
+)
+
+func init() {
+	for cmd, spec := range builtins {
+		registry[cmd] = spec
 	}
-	return false
 }
 
-func HasArg(cmd CmdType) bool {
-	switch cmd {
-	case RETR, PASS, USER, CWD, PORT, TYPE, STOR, DELE:
-		return true
+// Register adds a command so that it is recognized by the Scanner. Verbs are case-insensitive. A command
+// can be registered again with the same spec, e.g. by several servers, but built-in commands can't be
+// registered.
+func Register(verb CmdType, spec Spec) error {
+	word := strings.ToUpper(string(verb))
+	if word == "" || strings.IndexFunc(word, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return fmt.Errorf("Invalid command %s", verb)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	_, builtin := builtins[CmdType(word)]
+	if old, ok := registry[CmdType(word)]; ok && (builtin || old != spec) {
+		return fmt.Errorf("Command %s is already registered", word)
 	}
-	return false
+	registry[CmdType(word)] = spec
+	return nil
+}
+
+// Lookup returns the spec of a registered command.
+func Lookup(cmd CmdType) (Spec, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	spec, ok := registry[cmd]
+	return spec, ok
+}
+
+func (cmd CmdType) IsDataCMD() bool {
+	spec, _ := Lookup(cmd)
+	return spec.Data
+}
+
+func HasArg(cmd CmdType) bool {
+	spec, _ := Lookup(cmd)
+	return spec.Arg != NoArg
 }
 
 func IsCommand(str string) bool {
-	for _, cmd := range cmds {
-		if string(cmd) == str {
-			return true
-		}
-	}
-	return false
+	_, ok := Lookup(CmdType(str))
+	return ok
 }
@@ -5,56 +5,132 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
 )
 
+// MaxLineLength is the longest command line accepted, not counting the line terminator. Longer lines are
+// discarded and reported with LineTooLongError.
+const MaxLineLength = 4096
+
+// Telnet command bytes, see RFC 854.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
 type Cmd struct {
 	Type CmdType
 	Arg  string
 }
 
 type Scanner struct {
-	in *bufio.Scanner
+	in *bufio.Reader
 }
 
 func NewScanner(input io.Reader) *Scanner {
-	scanner := bufio.NewScanner(input)
-	//scanner.Split(bufio.ScanWords)
 	return &Scanner{
-		in: scanner,
+		in: bufio.NewReader(input),
 	}
 }
 
+// NextCommand reads the next command line, terminated by CRLF or a bare LF. Verbs are case-insensitive and
+// the argument is everything after the first space, so arguments containing spaces are preserved verbatim.
+// Telnet control sequences, such as the IP and DM sent before ABOR, are removed.
 func (p *Scanner) NextCommand() (*Cmd, error) {
-	line, ok := p.nextLine()
-	if !ok {
-		return nil, errors.New("No command")
+	line, err := p.nextLine()
+	if err != nil {
+		return nil, err
 	}
 	components := strings.SplitN(line, " ", 2)
-	word := components[0]
+	word := strings.ToUpper(components[0])
 
-	if !IsCommand(word) {
-		return nil, &ftp_error.InvalidCommandError{word}
-	}
 	cmd := CmdType(word)
-	if !HasArg(cmd) {
-		return &Cmd{Type: cmd}, nil
+	spec, ok := Lookup(cmd)
+	if !ok {
+		return nil, &ftp_error.InvalidCommandError{Cmd: components[0]}
 	}
-	//arg, ok := p.nextWord()
-	if len(components) < 2 || IsCommand(components[1]) {
+	arg := ""
+	if len(components) == 2 {
+		arg = components[1]
+	}
+	switch {
+	case spec.Arg == NoArg:
+		return &Cmd{Type: cmd}, nil
+	case spec.Arg == RequiredArg && arg == "":
 		return nil, &ftp_error.NoArgumentError{word}
 	}
-	return &Cmd{cmd, components[1]}, nil
+	return &Cmd{Type: cmd, Arg: arg}, nil
+}
+
+// nextLine reads a line and removes the line terminator and Telnet control sequences. A line that isn't
+// terminated before the end of the input is ignored.
+func (p *Scanner) nextLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		b, err := p.in.ReadByte()
+		if err != nil {
+			return "", errors.New("No command")
+		}
+		switch b {
+		case '\n':
+			if n := len(line); n > 0 && line[n-1] == '\r' {
+				line = line[:n-1]
+			}
+			if tooLong || len(line) > MaxLineLength {
+				return "", &ftp_error.LineTooLongError{Max: MaxLineLength}
+			}
+			return strings.TrimLeftFunc(string(line), isTelnetNoise), nil
+		case telnetIAC:
+			if b, err = p.telnetCommand(); err != nil {
+				return "", errors.New("No command")
+			}
+			if b != telnetIAC {
+				continue
+			}
+		}
+		// One byte more than the limit is kept for the CR of the terminator, the length is checked again
+		// once it's stripped.
+		if len(line) > MaxLineLength {
+			tooLong = true
+			continue
+		}
+		line = append(line, b)
+	}
 }
 
-func (p *Scanner) nextLine() (string, bool) {
-	if !p.in.Scan() {
-		return "", false
+// telnetCommand reads a Telnet command after an IAC byte. It returns IAC for an escaped 255 data byte, or
+// the command byte for commands that should be dropped.
+func (p *Scanner) telnetCommand() (byte, error) {
+	b, err := p.in.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b >= telnetWILL && b <= telnetDONT:
+		// Option negotiation is followed by the option code.
+		_, err = p.in.ReadByte()
+	case b == telnetSB:
+		// Subnegotiation lasts until IAC SE.
+		prev := byte(0)
+		for !(prev == telnetIAC && b == telnetSE) {
+			prev = b
+			if b, err = p.in.ReadByte(); err != nil {
+				break
+			}
+		}
+		b = telnetSE
 	}
-	return p.in.Text(), true
+	return b, err
 }
 
-func (p *Scanner) hasNext() bool {
-	return p.in.Scan()
+// isTelnetNoise reports whether r, at the start of a line, is left over from a Telnet sequence whose IAC was
+// sent as urgent data, which the socket doesn't deliver inline, or is a control character.
+func isTelnetNoise(r rune) bool {
+	return r < ' ' || r >= telnetSE && r <= telnetIAC || r == utf8.RuneError
 }
@@ -16,7 +16,21 @@ var tests = []struct {
 }{
 	{"CWD file/path\n", &ftp_cmd.Cmd{ftp_cmd.CWD, "file/path"}, nil},
 	{"CWD\n", nil, errors.New("No argument for command CWD")},
-	{"CWD PWD\n", nil, errors.New("No argument for command CWD")},
+	{"CWD PWD\n", &ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: "PWD"}, nil},
+	{"CWD \n", nil, errors.New("No argument for command CWD")},
+	{"cwd dir\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: "dir"}, nil},
+	{"Stor my  file .txt \r\n", &ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "my  file .txt "}, nil},
+	{"RETR a\rb\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "a\rb"}, nil},
+	{"\xff\xf4\xff\xf2PWD\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.PWD, Arg: ""}, nil},
+	{"\xff\xf4\xf2PWD\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.PWD, Arg: ""}, nil},
+	{"\xff\xfb\x01\xff\xfa\x18\x00\xff\xf0PWD\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.PWD, Arg: ""}, nil},
+	{"RETR a\xff\xffb\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "a\xffb"}, nil},
+	{"RETR " + strings.Repeat("a", ftp_cmd.MaxLineLength) + "\r\n", nil, errors.New("Command line longer than 4096 bytes")},
+	{"RETR " + strings.Repeat("a", ftp_cmd.MaxLineLength-5) + "\r\n", &ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: strings.Repeat("a", ftp_cmd.MaxLineLength-5)}, nil},
+	{"RETR " + strings.Repeat("a", ftp_cmd.MaxLineLength-5) + "\n", &ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: strings.Repeat("a", ftp_cmd.MaxLineLength-5)}, nil},
+	{"RETR " + strings.Repeat("a", ftp_cmd.MaxLineLength-4) + "\r\n", nil, errors.New("Command line longer than 4096 bytes")},
+	{"RETR " + strings.Repeat("a", ftp_cmd.MaxLineLength-4) + "\n", nil, errors.New("Command line longer than 4096 bytes")},
+	{"PWD", nil, errors.New("No command")},
 	{"PWD\n", &ftp_cmd.Cmd{ftp_cmd.PWD, ""}, nil},
 	{"USER demo\n", &ftp_cmd.Cmd{ftp_cmd.USER, "demo"}, nil},
 	{"USER\n", nil, errors.New("No argument for command USER")},
@@ -30,9 +44,22 @@ var tests = []struct {
 	{"PASV\n", &ftp_cmd.Cmd{ftp_cmd.PASV, ""}, nil},
 	{"\n", nil, errors.New("Invalid Command: ")},
 	{"PASR\n", nil, errors.New("Invalid Command: PASR")},
+	{"pasr\n", nil, errors.New("Invalid Command: pasr")},
 	{"", nil, errors.New("No command")},
 }
 
+func TestScannerAfterLongLine(t *testing.T) {
+	in := "RETR " + strings.Repeat("a", 2*ftp_cmd.MaxLineLength) + "\r\nPWD\r\n"
+	scanner := ftp_cmd.NewScanner(strings.NewReader(in))
+	if _, err := scanner.NextCommand(); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "Command line longer than 4096 bytes")
+	}
+	cmd, err := scanner.NextCommand()
+	if err != nil || cmd.Type != ftp_cmd.PWD {
+		t.Errorf("Error actual = %v, and Expected = %v.", cmd, ftp_cmd.PWD)
+	}
+}
+
 func TestScanner(t *testing.T) {
 	for _, test := range tests {
 		scanner := ftp_cmd.NewScanner(strings.NewReader(test.in))
@@ -54,3 +81,40 @@ func TestScanner(t *testing.T) {
 		}
 	}
 }
+
+func TestRegister(t *testing.T) {
+	var tests = []struct {
+		verb        ftp_cmd.CmdType
+		spec        ftp_cmd.Spec
+		expectedErr error
+	}{
+		{"XSTATS", ftp_cmd.Spec{Arg: ftp_cmd.OptionalArg}, nil},
+		{"xstats", ftp_cmd.Spec{Arg: ftp_cmd.OptionalArg}, nil},
+		{"XSTATS", ftp_cmd.Spec{Arg: ftp_cmd.RequiredArg}, errors.New("Command XSTATS is already registered")},
+		{"XPING", ftp_cmd.Spec{NoAuth: true}, nil},
+		{"RETR", ftp_cmd.Spec{Arg: ftp_cmd.RequiredArg, Data: true}, errors.New("Command RETR is already registered")},
+		{"X-1", ftp_cmd.Spec{}, errors.New("Invalid command X-1")},
+		{"", ftp_cmd.Spec{}, errors.New("Invalid command ")},
+	}
+	for _, test := range tests {
+		err := ftp_cmd.Register(test.verb, test.spec)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+	}
+
+	var commands = []struct {
+		in       string
+		expected *ftp_cmd.Cmd
+	}{
+		{"xstats\r\n", &ftp_cmd.Cmd{Type: "XSTATS"}},
+		{"XSTATS today\r\n", &ftp_cmd.Cmd{Type: "XSTATS", Arg: "today"}},
+		{"XPING now\r\n", &ftp_cmd.Cmd{Type: "XPING"}},
+	}
+	for _, test := range commands {
+		cmd, err := ftp_cmd.NewScanner(strings.NewReader(test.in)).NextCommand()
+		if err != nil || *cmd != *test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", cmd, *test.expected)
+		}
+	}
+}
@@ -4,6 +4,13 @@ import (
 	"fmt"
 )
 
+// ReplyError is implemented by errors that are reported to the client, Reply returns the reply code
+// and text to send.
+type ReplyError interface {
+	error
+	Reply() (int, string)
+}
+
 type NotImplementedError struct {
 	Cmd string
 }
@@ -26,6 +33,10 @@ func (e *InvalidCommandError) Error() string {
 	return fmt.Sprintf("Invalid Command: %s", e.Cmd)
 }
 
+func (e *InvalidCommandError) Reply() (int, string) {
+	return 500, fmt.Sprintf("'%s': command not understood.", e.Cmd)
+}
+
 type NoArgumentError struct {
 	Cmd string
 }
@@ -34,10 +45,164 @@ func (e *NoArgumentError) Error() string {
 	return fmt.Sprintf("No argument for command %s", e.Cmd)
 }
 
+func (e *NoArgumentError) Reply() (int, string) {
+	return 501, "Syntax error in parameters or arguments."
+}
+
+type InvalidEncodingError struct {
+	Arg string
+}
+
+func (e *InvalidEncodingError) Error() string {
+	return fmt.Sprintf("Invalid encoding of %q", e.Arg)
+}
+
+func (e *InvalidEncodingError) Reply() (int, string) {
+	return 501, "Invalid UTF-8 in argument."
+}
+
+type LineTooLongError struct {
+	Max int
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("Command line longer than %d bytes", e.Max)
+}
+
+func (e *LineTooLongError) Reply() (int, string) {
+	return 500, "Command line too long."
+}
+
 type FileNotFoundError struct {
 	File string
 }
 
 func (e *FileNotFoundError) Error() string {
-	return fmt.Sprintf("No argument for command %s", e.File)
+	return fmt.Sprintf("File %s not found", e.File)
+}
+
+func (e *FileNotFoundError) Reply() (int, string) {
+	return 550, "File not found."
+}
+
+type InvalidPathError struct {
+	Path string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("Invalid path %s", e.Path)
+}
+
+func (e *InvalidPathError) Reply() (int, string) {
+	return 553, "Requested action not taken. File name not allowed."
+}
+
+type DataConnectionError struct {
+	Err error
+}
+
+func (e *DataConnectionError) Error() string {
+	return fmt.Sprintf("Can't open data connection: %v", e.Err)
+}
+
+func (e *DataConnectionError) Reply() (int, string) {
+	return 425, "Can't open data connection."
+}
+
+type TransferAbortedError struct {
+	Err error
+}
+
+func (e *TransferAbortedError) Error() string {
+	return fmt.Sprintf("Transfer aborted: %v", e.Err)
+}
+
+func (e *TransferAbortedError) Reply() (int, string) {
+	return 426, "Connection closed; transfer aborted."
+}
+
+type FileUnavailableError struct {
+	File string
+	Err  error
+}
+
+func (e *FileUnavailableError) Error() string {
+	return fmt.Sprintf("File %s unavailable: %v", e.File, e.Err)
+}
+
+func (e *FileUnavailableError) Reply() (int, string) {
+	return 450, "Requested file action not taken. File unavailable."
+}
+
+type LocalError struct {
+	Err error
+}
+
+func (e *LocalError) Error() string {
+	return fmt.Sprintf("Local error: %v", e.Err)
+}
+
+func (e *LocalError) Reply() (int, string) {
+	return 451, "Requested action aborted: local error in processing."
+}
+
+type QuotaExceededError struct {
+	User string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Quota of %s exceeded", e.User)
+}
+
+func (e *QuotaExceededError) Reply() (int, string) {
+	return 552, "Exceeded storage allocation."
+}
+
+type PermissionDeniedError struct {
+	Path string
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("Permission denied: %s", e.Path)
+}
+
+func (e *PermissionDeniedError) Reply() (int, string) {
+	return 550, "Permission denied."
+}
+
+type FileBusyError struct {
+	File string
+}
+
+func (e *FileBusyError) Error() string {
+	return fmt.Sprintf("File %s is busy", e.File)
+}
+
+func (e *FileBusyError) Reply() (int, string) {
+	return 450, "File busy."
+}
+
+type FileNameNotAllowedError struct {
+	File string
+}
+
+func (e *FileNameNotAllowedError) Error() string {
+	return fmt.Sprintf("File name %s not allowed", e.File)
+}
+
+func (e *FileNameNotAllowedError) Reply() (int, string) {
+	return 553, "Requested action not taken. File name not allowed."
+}
+
+type FileTooLargeError struct {
+	File string
+	Max  int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("File %s exceeds %d bytes", e.File, e.Max)
+}
+
+func (e *FileTooLargeError) Reply() (int, string) {
+	return 552, fmt.Sprintf("Exceeded the maximum file size of %d bytes.", e.Max)
 }
@@ -0,0 +1,137 @@
+package ftp_filter
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// Rule restricts the uploads into a directory, by a user, or both. Names are matched case-insensitively.
+type Rule struct {
+	// Dir is the virtual directory the rule applies to, including its subdirectories. Empty means everywhere.
+	Dir string `json:"dir,omitempty"`
+	// User is the user the rule applies to. Empty means everybody.
+	User string `json:"user,omitempty"`
+	// Allow are globs, e.g. "report-*.csv", of which a name must match at least one if there are any.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are globs that a name must not match.
+	Deny []string `json:"deny,omitempty"`
+	// AllowExt are extensions, e.g. "csv", of which a name must have one if there are any.
+	AllowExt []string `json:"allow_ext,omitempty"`
+	// DenyExt are extensions that a name must not have.
+	DenyExt []string `json:"deny_ext,omitempty"`
+	// DenyHidden rejects names starting with a dot.
+	DenyHidden bool `json:"deny_hidden,omitempty"`
+	// MaxSize is the largest file in bytes that may be uploaded. Zero means unlimited.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// Filter checks uploads against rules. All rules that apply to an upload must allow it, the smallest
+// MaxSize of them is enforced.
+type Filter struct {
+	rules []Rule
+}
+
+// Public Methods
+
+func New(rules ...Rule) *Filter {
+	f := &Filter{}
+	for _, rule := range rules {
+		if rule.Dir != "" {
+			rule.Dir = path.Clean("/" + rule.Dir)
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f
+}
+
+// Check checks the upload of the file at the virtual path by user. It returns the maximum size of the file,
+// zero for unlimited, or an ftp_error.FileNameNotAllowedError if the name isn't allowed. A nil filter allows
+// everything.
+func (f *Filter) Check(user, virtual string) (int64, error) {
+	if f == nil {
+		return 0, nil
+	}
+	name := strings.ToLower(path.Base(virtual))
+	max := int64(0)
+	for _, rule := range f.rules {
+		if !rule.appliesTo(user, path.Dir(virtual)) {
+			continue
+		}
+		if !rule.allows(name) {
+			return 0, &ftp_error.FileNameNotAllowedError{File: virtual}
+		}
+		if rule.MaxSize > 0 && (max == 0 || rule.MaxSize < max) {
+			max = rule.MaxSize
+		}
+	}
+	return max, nil
+}
+
+// LimitWriter returns a writer that writes to w until more than max bytes are written, which fails with an
+// ftp_error.FileTooLargeError. Zero means unlimited.
+func LimitWriter(w io.Writer, max int64, file string) io.Writer {
+	if max <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, max: max, file: file}
+}
+
+// Private Methods
+
+func (rule *Rule) appliesTo(user, dir string) bool {
+	if rule.User != "" && rule.User != user {
+		return false
+	}
+	return rule.Dir == "" || rule.Dir == "/" || dir == rule.Dir || strings.HasPrefix(dir, rule.Dir+"/")
+}
+
+func (rule *Rule) allows(name string) bool {
+	if rule.DenyHidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if matchesAny(rule.Deny, name) || hasExt(rule.DenyExt, ext) {
+		return false
+	}
+	if len(rule.Allow) == 0 && len(rule.AllowExt) == 0 {
+		return true
+	}
+	return matchesAny(rule.Allow, name) || hasExt(rule.AllowExt, ext)
+}
+
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(strings.ToLower(glob), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+type limitWriter struct {
+	w       io.Writer
+	max     int64
+	file    string
+	written int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.written+int64(len(p)) > lw.max {
+		return 0, &ftp_error.FileTooLargeError{File: lw.file, Max: lw.max}
+	}
+	n, err := lw.w.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
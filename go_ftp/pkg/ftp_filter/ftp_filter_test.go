@@ -0,0 +1,70 @@
+package ftp_filter_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_filter"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func TestCheck(t *testing.T) {
+	filter := ftp_filter.New(
+		ftp_filter.Rule{Dir: "csv/", AllowExt: []string{".csv"}, Allow: []string{"README"}, MaxSize: 100},
+		ftp_filter.Rule{Dir: "/csv/archive", MaxSize: 1000},
+		ftp_filter.Rule{User: "guest", DenyHidden: true, DenyExt: []string{"exe", "sh"}, MaxSize: 10},
+		ftp_filter.Rule{Deny: []string{"*~"}})
+	notAllowed := func(file string) error {
+		return errors.New("File name " + file + " not allowed")
+	}
+	var tests = []struct {
+		user        string
+		path        string
+		expectedMax int64
+		expectedErr error
+	}{
+		{"alice", "/tool.exe", 0, nil},
+		{"alice", "/.profile", 0, nil},
+		{"alice", "/notes.txt~", 0, notAllowed("/notes.txt~")},
+		{"guest", "/tool.EXE", 0, notAllowed("/tool.EXE")},
+		{"guest", "/.profile", 0, notAllowed("/.profile")},
+		{"guest", "/notes.txt", 10, nil},
+		{"alice", "/csv/data.CSV", 100, nil},
+		{"alice", "/csv/README", 100, nil},
+		{"alice", "/csv/data.xlsx", 0, notAllowed("/csv/data.xlsx")},
+		{"alice", "/csv/archive/2020.csv", 100, nil},
+		{"guest", "/csv/archive/2020.csv", 10, nil},
+		{"alice", "/csvfiles/data.xlsx", 0, nil},
+	}
+	for _, test := range tests {
+		max, err := filter.Check(test.user, test.path)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if max != test.expectedMax {
+			t.Errorf("Error actual = %v, and Expected = %v.", max, test.expectedMax)
+		}
+	}
+
+	var nilFilter *ftp_filter.Filter
+	if max, err := nilFilter.Check("alice", "/tool.exe"); max != 0 || err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := ftp_filter.LimitWriter(&buf, 4, "/file")
+	if _, err := w.Write([]byte("abcd")); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+	_, err := w.Write([]byte("e"))
+	expectedErr := errors.New("File /file exceeds 4 bytes")
+	if ok, have, want := test_utils.VerifyError(err, expectedErr); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	if buf.String() != "abcd" {
+		t.Errorf("Error actual = %v, and Expected = %v.", buf.String(), "abcd")
+	}
+}
@@ -0,0 +1,87 @@
+package ftp_hash
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+type Algorithm string
+
+const (
+	SHA256 Algorithm = "SHA-256"
+	SHA1             = "SHA-1"
+	MD5              = "MD5"
+	CRC32            = "CRC32"
+)
+
+// Algorithms lists the supported algorithms, the first one is the default.
+var Algorithms = []Algorithm{
+	SHA256,
+	SHA1,
+	MD5,
+	CRC32,
+}
+
+func Parse(name string) (Algorithm, bool) {
+	for _, algo := range Algorithms {
+		if strings.EqualFold(string(algo), name) {
+			return algo, true
+		}
+	}
+	return "", false
+}
+
+func (algo Algorithm) New() hash.Hash {
+	switch algo {
+	case SHA1:
+		return sha1.New()
+	case MD5:
+		return md5.New()
+	case CRC32:
+		return crc32.NewIEEE()
+	default:
+		return sha256.New()
+	}
+}
+
+// Reader returns the hex encoded hash of everything read from r.
+func Reader(r io.Reader, algo Algorithm) (string, error) {
+	h := algo.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// File returns the hex encoded hash of the bytes start to end (inclusive) of the file at path.
+// An end of -1 means the end of the file. The end actually used is returned together with the hash.
+func File(path string, algo Algorithm, start, end int64) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if end < 0 || end >= info.Size() {
+		end = info.Size() - 1
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	length := end - start + 1
+	if length < 0 {
+		length = 0
+	}
+	sum, err := Reader(io.LimitReader(file, length), algo)
+	return sum, end, err
+}
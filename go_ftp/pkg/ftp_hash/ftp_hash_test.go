@@ -0,0 +1,88 @@
+package ftp_hash_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hash"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected ftp_hash.Algorithm
+		ok       bool
+	}{
+		{"SHA-256", ftp_hash.SHA256, true},
+		{"sha-1", ftp_hash.SHA1, true},
+		{"Md5", ftp_hash.MD5, true},
+		{"CRC32", ftp_hash.CRC32, true},
+		{"SHA-512", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		actual, ok := ftp_hash.Parse(test.name)
+		if actual != test.expected || ok != test.ok {
+			t.Errorf("Error actual = %v %v, and Expected = %v %v.", actual, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	var tests = []struct {
+		algo     ftp_hash.Algorithm
+		expected string
+	}{
+		{ftp_hash.SHA256, "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f"},
+		{ftp_hash.SHA1, "0a0a9f2a6772942557ab5355d76af442f8f65e01"},
+		{ftp_hash.MD5, "65a8e27d8879283831b664bd8b7f0ad4"},
+		{ftp_hash.CRC32, "ec4ac3d0"},
+	}
+	for _, test := range tests {
+		actual, err := ftp_hash.Reader(strings.NewReader("Hello, World!"), test.algo)
+		if err != nil || actual != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp_hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, empty := filepath.Join(dir, "file"), filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(file, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path        string
+		start       int64
+		end         int64
+		expected    string
+		expectedEnd int64
+	}{
+		{file, 0, -1, "65a8e27d8879283831b664bd8b7f0ad4", 12},
+		{file, 7, 11, "f5a7924e621e84c9280a9a27e1bcb7f6", 11},
+		// The end is limited to the size of the file.
+		{file, 0, 100, "65a8e27d8879283831b664bd8b7f0ad4", 12},
+		{empty, 0, -1, "d41d8cd98f00b204e9800998ecf8427e", -1},
+	}
+	for _, test := range tests {
+		actual, end, err := ftp_hash.File(test.path, ftp_hash.MD5, test.start, test.end)
+		if err != nil || actual != test.expected || end != test.expectedEnd {
+			t.Errorf("Error actual = %v %v %v, and Expected = %v %v.", actual, end, err, test.expected, test.expectedEnd)
+		}
+	}
+	if _, _, err := ftp_hash.File(filepath.Join(dir, "missing"), ftp_hash.MD5, 0, -1); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "error")
+	}
+}
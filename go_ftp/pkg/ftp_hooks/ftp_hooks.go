@@ -0,0 +1,51 @@
+package ftp_hooks
+
+import (
+	"fmt"
+)
+
+// Session describes the client session a hook is invoked for.
+type Session struct {
+	User       string
+	RemoteAddr string
+}
+
+// Hooks lets an embedding application observe and control what happens on the server.
+// The Before* hooks may veto an operation by returning an error, if the error is a *Veto
+// its reply code and message are sent to the client, otherwise a 550 reply is sent.
+type Hooks interface {
+	OnConnect(s Session)
+	OnLogin(s Session, success bool)
+	BeforeUpload(s Session, path string) error
+	AfterUpload(s Session, path string, size int64)
+	BeforeDownload(s Session, path string) error
+	OnDelete(s Session, path string)
+	OnRename(s Session, from, to string)
+	OnDisconnect(s Session)
+}
+
+// Veto is returned by a Before* hook to reject an operation with a custom reply.
+type Veto struct {
+	Code    int
+	Message string
+}
+
+func (v *Veto) Error() string {
+	return fmt.Sprintf("%d %s", v.Code, v.Message)
+}
+
+func (v *Veto) Reply() (int, string) {
+	return v.Code, v.Message
+}
+
+// NopHooks implements Hooks without doing anything. Embed it to only implement the hooks you need.
+type NopHooks struct{}
+
+func (NopHooks) OnConnect(s Session)                            {}
+func (NopHooks) OnLogin(s Session, success bool)                {}
+func (NopHooks) BeforeUpload(s Session, path string) error      { return nil }
+func (NopHooks) AfterUpload(s Session, path string, size int64) {}
+func (NopHooks) BeforeDownload(s Session, path string) error    { return nil }
+func (NopHooks) OnDelete(s Session, path string)                {}
+func (NopHooks) OnRename(s Session, from, to string)            {}
+func (NopHooks) OnDisconnect(s Session)                         {}
@@ -4,11 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
+// UnsupportedProtocolError is returned by DecodeExtended for network protocols other than 1 (IPv4) and
+// 2 (IPv6).
+type UnsupportedProtocolError struct {
+	Proto string
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return "Unsupported network protocol"
+}
+
 func Decode(addr string) (string, error) {
 	re := regexp.MustCompile(`(\d+,){5}\d+`)
 	str := re.FindString(addr)
@@ -16,21 +27,48 @@ func Decode(addr string) (string, error) {
 		return "", errors.New("Invalid addr format")
 	}
 	components := strings.Split(str, ",")
-	host := strings.Join(components[:4], ".")
-	portPart1, err := strconv.Atoi(components[4])
-	if err != nil {
-		log.Fatal(err)
-	}
-	portPart2, err := strconv.Atoi(components[5])
-	if err != nil {
-		log.Fatal(err)
+	// Each component is a byte, larger values would give invalid hosts or ports above 65535.
+	for _, c := range components {
+		if n, err := strconv.Atoi(c); err != nil || n > 255 {
+			return "", errors.New("Invalid addr format")
+		}
 	}
+	host := strings.Join(components[:4], ".")
+	portPart1, _ := strconv.Atoi(components[4])
+	portPart2, _ := strconv.Atoi(components[5])
 
 	port := portPart1*256 + portPart2
 
 	return fmt.Sprintf("%s:%d", host, port), nil
 }
 
+// DecodeExtended decodes an RFC 2428 address such as "|1|132.235.1.2|6275|" or "|2|::1|6275|".
+func DecodeExtended(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if len(addr) < 2 {
+		return "", errors.New("Invalid addr format")
+	}
+	components := strings.Split(addr, addr[:1])
+	if len(components) != 5 || components[0] != "" || components[4] != "" {
+		return "", errors.New("Invalid addr format")
+	}
+	proto, host, port := components[1], components[2], components[3]
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "", errors.New("Invalid addr format")
+	case proto == "1" && ip.To4() == nil, proto == "2" && ip.To4() != nil:
+		return "", errors.New("Invalid addr format")
+	case proto != "1" && proto != "2":
+		return "", &UnsupportedProtocolError{Proto: proto}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return "", errors.New("Invalid addr format")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
 func Encode(ip, port string) (string, error) {
 	var addr string
 	if ip == "" {
@@ -38,7 +76,6 @@ func Encode(ip, port string) (string, error) {
 	} else {
 		addr = fmt.Sprintf("%s:%s", ip, port)
 	}
-	fmt.Println(addr)
 	re := regexp.MustCompile(`\d+.\d+.\d+.\d+:\d+`)
 	matched := re.MatchString(addr)
 	if !matched {
@@ -30,6 +30,23 @@ var decodeTests = []struct {
 	{"127,0,0,1,2,0", "127.0.0.1:512", nil},
 	{"127,0,0,1,2", "", errors.New("Invalid addr format")},
 	{"1,2,,4,5,6", "", errors.New("Invalid addr format")},
+	{"127,0,0,1,256,1", "", errors.New("Invalid addr format")},
+	{"127,0,0,1,1,256", "", errors.New("Invalid addr format")},
+	{"127,0,0,300,2,1", "", errors.New("Invalid addr format")},
+}
+
+var decodeExtendedTests = []struct {
+	input       string
+	expected    string
+	expectedErr error
+}{
+	{"|1|132.235.1.2|6275|", "132.235.1.2:6275", nil},
+	{"|2|1080::8:800:200C:417A|5282|", "[1080::8:800:200C:417A]:5282", nil},
+	{"!1!127.0.0.1!21!", "127.0.0.1:21", nil},
+	{"|1|::1|5282|", "", errors.New("Invalid addr format")},
+	{"|3|127.0.0.1|21|", "", &ftp_ip.UnsupportedProtocolError{Proto: "3"}},
+	{"|1|127.0.0.1|70000|", "", errors.New("Invalid addr format")},
+	{"|1|127.0.0.1|21", "", errors.New("Invalid addr format")},
 }
 
 func TestFtpIPEncode(t *testing.T) {
@@ -55,3 +72,15 @@ func TestFtpIPDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestFtpIPDecodeExtended(t *testing.T) {
+	for _, test := range decodeExtendedTests {
+		decoded, err := ftp_ip.DecodeExtended(test.input)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if decoded != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", decoded, test.expected)
+		}
+	}
+}
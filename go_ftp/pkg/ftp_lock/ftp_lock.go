@@ -0,0 +1,216 @@
+package ftp_lock
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// Policy decides what happens when a file that is being read is deleted or renamed.
+type Policy int
+
+const (
+	// Reject fails the delete or rename with "450 File busy".
+	Reject Policy = iota
+	// Wait waits for the readers to finish, and fails like Reject if they don't within the wait time.
+	Wait
+)
+
+// Manager keeps track of the files that are being read and written by all sessions. Any number of sessions
+// may read a file, but only one may write, delete or rename it at a time. Files being read may be replaced by
+// uploads since uploads are renamed into place, while deletes and renames are handled according to the policy.
+type Manager struct {
+	mu      sync.Mutex
+	files   map[string]*file
+	changed chan struct{}
+	policy  Policy
+	wait    time.Duration
+}
+
+type file struct {
+	readers int
+	writer  bool
+}
+
+// Locker holds the locks of one session.
+type Locker struct {
+	m    *Manager
+	mu   sync.Mutex
+	held map[int]func()
+	next int
+}
+
+// Public Methods
+
+func NewManager(policy Policy, wait time.Duration) *Manager {
+	return &Manager{
+		files:   make(map[string]*file),
+		changed: make(chan struct{}),
+		policy:  policy,
+		wait:    wait,
+	}
+}
+
+// NewLocker returns a Locker for a new session.
+func (m *Manager) NewLocker() *Locker {
+	return &Locker{m: m, held: make(map[int]func())}
+}
+
+// Read locks path for reading. The returned function releases the lock.
+func (l *Locker) Read(path string) func() {
+	m := l.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.get(path)
+	f.readers++
+	return l.hold(func() {
+		f.readers--
+		m.put(path)
+	})
+}
+
+// Write locks path for writing. It fails with a ftp_error.FileBusyError if path is already being written,
+// deleted or renamed.
+func (l *Locker) Write(path string) (func(), error) {
+	m := l.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.get(path)
+	if f.writer {
+		m.put(path)
+		return nil, &ftp_error.FileBusyError{File: path}
+	}
+	f.writer = true
+	return l.hold(func() {
+		f.writer = false
+		m.put(path)
+	}), nil
+}
+
+// Remove locks paths for a delete or rename. It fails with a ftp_error.FileBusyError if any of them is being
+// written, or is being read and the readers aren't done in time according to the policy.
+func (l *Locker) Remove(paths ...string) (func(), error) {
+	m := l.m
+	var timeout <-chan time.Time
+	if m.policy == Wait {
+		timer := time.NewTimer(m.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		written, read := m.busy(paths)
+		if written != "" {
+			return nil, &ftp_error.FileBusyError{File: written}
+		}
+		if read == "" {
+			break
+		}
+		if m.policy == Reject {
+			return nil, &ftp_error.FileBusyError{File: read}
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+			m.mu.Lock()
+		case <-timeout:
+			m.mu.Lock()
+			return nil, &ftp_error.FileBusyError{File: read}
+		}
+	}
+	var files []*file
+	for _, path := range paths {
+		f := m.get(path)
+		f.writer = true
+		files = append(files, f)
+	}
+	return l.hold(func() {
+		for i, f := range files {
+			f.writer = false
+			m.put(paths[i])
+		}
+	}), nil
+}
+
+// ReleaseAll releases all locks held by the session.
+func (l *Locker) ReleaseAll() {
+	l.mu.Lock()
+	held := l.held
+	l.held = make(map[int]func())
+	l.mu.Unlock()
+	for _, release := range held {
+		release()
+	}
+}
+
+// Private Methods
+
+// hold registers release, which must be called with the manager locked, as held by the session and returns a
+// function that releases it once.
+func (l *Locker) hold(release func()) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.next
+	l.next++
+	var once sync.Once
+	wrapped := func() {
+		once.Do(func() {
+			l.m.mu.Lock()
+			defer l.m.mu.Unlock()
+			release()
+			l.m.notify()
+		})
+	}
+	l.held[id] = wrapped
+	return func() {
+		l.mu.Lock()
+		delete(l.held, id)
+		l.mu.Unlock()
+		wrapped()
+	}
+}
+
+// busy returns the first of paths that is being written and the first that is being read, or "" if there
+// is none.
+func (m *Manager) busy(paths []string) (string, string) {
+	written, read := "", ""
+	for _, path := range paths {
+		if f, ok := m.files[filepath.Clean(path)]; ok {
+			if f.writer && written == "" {
+				written = path
+			}
+			if f.readers > 0 && read == "" {
+				read = path
+			}
+		}
+	}
+	return written, read
+}
+
+func (m *Manager) get(path string) *file {
+	path = filepath.Clean(path)
+	f, ok := m.files[path]
+	if !ok {
+		f = &file{}
+		m.files[path] = f
+	}
+	return f
+}
+
+// put forgets path if it isn't locked anymore.
+func (m *Manager) put(path string) {
+	path = filepath.Clean(path)
+	if f, ok := m.files[path]; ok && f.readers == 0 && !f.writer {
+		delete(m.files, path)
+	}
+}
+
+// notify wakes up the deletes and renames that wait for readers.
+func (m *Manager) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
@@ -0,0 +1,64 @@
+package ftp_lock_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_lock"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func TestLocker(t *testing.T) {
+	m := ftp_lock.NewManager(ftp_lock.Reject, 0)
+	a, b := m.NewLocker(), m.NewLocker()
+
+	releaseRead := a.Read("/root/file")
+	releaseWrite, err := a.Write("/root/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		lock        func() (func(), error)
+		expectedErr error
+	}{
+		// Uploads may replace files that are being read, but only one at a time.
+		{func() (func(), error) { return b.Write("/root/file") }, errors.New("File /root/file is busy")},
+		{func() (func(), error) { return b.Write("/root/other") }, nil},
+		{func() (func(), error) { return b.Remove("/root/file") }, errors.New("File /root/file is busy")},
+		{func() (func(), error) { return b.Remove("/root/./other") }, errors.New("File /root/./other is busy")},
+		// The error names the path that is locked, e.g. the target of a rename.
+		{func() (func(), error) { return b.Remove("/root/free", "/root/other") }, errors.New("File /root/other is busy")},
+		{func() (func(), error) { a.Read("/root/read"); return b.Remove("/root/free", "/root/read") }, errors.New("File /root/read is busy")},
+		{func() (func(), error) { releaseWrite(); return b.Remove("/root/file") }, errors.New("File /root/file is busy")},
+		{func() (func(), error) { releaseRead(); return b.Remove("/root/file", "/root/new") }, nil},
+		{func() (func(), error) { return a.Write("/root/new") }, errors.New("File /root/new is busy")},
+		{func() (func(), error) { b.ReleaseAll(); return a.Write("/root/new") }, nil},
+	}
+	for _, test := range tests {
+		_, err := test.lock()
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+	}
+}
+
+func TestWaitPolicy(t *testing.T) {
+	m := ftp_lock.NewManager(ftp_lock.Wait, 50*time.Millisecond)
+	a, b := m.NewLocker(), m.NewLocker()
+
+	a.Read("/root/file")
+	if _, err := b.Remove("/root/file"); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "File /root/file is busy")
+	}
+
+	release := a.Read("/root/file")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+		a.ReleaseAll()
+	}()
+	if _, err := b.Remove("/root/file"); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+}
@@ -0,0 +1,153 @@
+package ftp_path
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// Resolver maps the paths sent by a client onto the host file system, making sure they never leave root
+// or the root of the mount they are in.
+type Resolver struct {
+	root           string
+	followSymlinks bool
+	mounts         []Mount
+}
+
+// Mount maps the virtual directory Path, e.g. "/releases", and everything below it to the host directory Root.
+type Mount struct {
+	Path     string
+	Root     string
+	ReadOnly bool
+}
+
+// Public Methods
+
+// NewResolver creates a resolver jailed to root and the roots of mounts. If followSymlinks is set, symlinks
+// that point outside of root are followed, otherwise they are refused.
+func NewResolver(root string, followSymlinks bool, mounts ...Mount) *Resolver {
+	r := &Resolver{
+		root:           root,
+		followSymlinks: followSymlinks,
+	}
+	for _, m := range mounts {
+		m.Path = path.Clean("/" + m.Path)
+		r.mounts = append(r.mounts, m)
+	}
+	return r
+}
+
+func (r *Resolver) Root() string {
+	return r.root
+}
+
+func (r *Resolver) FollowSymlinks() bool {
+	return r.followSymlinks
+}
+
+func (r *Resolver) Mounts() []Mount {
+	return r.mounts
+}
+
+// Writable reports whether the file or directory at the virtual path may be created, changed or removed.
+// Mount points themselves and everything in read-only mounts are not writable.
+func (r *Resolver) Writable(virtual string) bool {
+	m, ok := r.mountOf(virtual)
+	if !ok {
+		return true
+	}
+	return !m.ReadOnly && m.Path != virtual
+}
+
+// MountsIn returns the mounts whose mount point is directly inside the virtual directory dir.
+func (r *Resolver) MountsIn(dir string) []Mount {
+	var mounts []Mount
+	for _, m := range r.mounts {
+		if m.Path != "/" && path.Dir(m.Path) == dir {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts
+}
+
+// Resolve resolves name relative to the virtual directory cwd. It returns the canonical virtual path,
+// which always starts with "/", and the corresponding path on the host.
+func (r *Resolver) Resolve(cwd, name string) (string, string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", "", &ftp_error.InvalidPathError{Path: name}
+	}
+	// Some clients use backslash as separator, treat it as one so that "..\" can't be used to escape.
+	name = strings.Replace(name, "\\", "/", -1)
+	if !path.IsAbs(name) {
+		name = path.Join(cwd, name)
+	}
+	virtual := path.Clean("/" + name)
+	root, rel := r.root, virtual
+	if m, ok := r.mountOf(virtual); ok {
+		root, rel = m.Root, strings.TrimPrefix(virtual, m.Path)
+	}
+	host := filepath.Join(root, filepath.FromSlash(rel))
+	if r.followSymlinks {
+		return virtual, host, nil
+	}
+	if err := verifyInsideRoot(root, host); err != nil {
+		return "", "", &ftp_error.InvalidPathError{Path: virtual}
+	}
+	return virtual, host, nil
+}
+
+// Private Methods
+
+// mountOf returns the innermost mount that contains the virtual path.
+func (r *Resolver) mountOf(virtual string) (Mount, bool) {
+	var mount Mount
+	found := false
+	for _, m := range r.mounts {
+		inside := m.Path == virtual || m.Path == "/" || strings.HasPrefix(virtual, m.Path+"/")
+		if inside && (!found || len(m.Path) > len(mount.Path)) {
+			mount, found = m, true
+		}
+	}
+	return mount, found
+}
+
+// verifyInsideRoot evaluates all symlinks of host and returns an error if the result is outside of root.
+// Components that don't exist yet, e.g. the target of an upload, are allowed unless they are dangling symlinks.
+func verifyInsideRoot(root, host string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	existing, rest := host, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	// Fails if existing can't be evaluated, e.g. if it is a dangling symlink.
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !isInside(realRoot, filepath.Join(resolved, rest)) {
+		return &ftp_error.InvalidPathError{Path: host}
+	}
+	return nil
+}
+
+func isInside(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,174 @@
+package ftp_path_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+var resolveTests = []struct {
+	cwd             string
+	input           string
+	followSymlinks  bool
+	expectedVirtual string
+	expectedErr     error
+}{
+	// Traversal using ..
+	{"/", "../../etc/passwd", false, "/etc/passwd", nil},
+	{"/sub", "../..", false, "/", nil},
+	{"/sub", "./../sub/../../sub", false, "/sub", nil},
+	// Absolute paths
+	{"/sub", "/etc/passwd", false, "/etc/passwd", nil},
+	{"/sub", "//sub//file", false, "/sub/file", nil},
+	// Encoded separators are never decoded, and backslashes are treated as separators
+	{"/", "..\\..\\etc", false, "/etc", nil},
+	{"/", "%2e%2e%2fetc", false, "/%2e%2e%2fetc", nil},
+	{"/", "..%2f..%2fetc", false, "/..%2f..%2fetc", nil},
+	{"/", "sub\x00/../..", false, "", errors.New("Invalid path sub\x00/../..")},
+	// Symlinks
+	{"/", "in/file", false, "/in/file", nil},
+	{"/", "out", false, "", errors.New("Invalid path /out")},
+	{"/", "out/file", false, "", errors.New("Invalid path /out/file")},
+	{"/sub", "../out/new_file", false, "", errors.New("Invalid path /out/new_file")},
+	{"/", "chain_out", false, "", errors.New("Invalid path /chain_out")},
+	{"/", "chain_in", false, "/chain_in", nil},
+	{"/", "dangling", false, "", errors.New("Invalid path /dangling")},
+	{"/", "out/file", true, "/out/file", nil},
+	{"/", "chain_out", true, "/chain_out", nil},
+}
+
+func TestResolve(t *testing.T) {
+	root, outside := initDirs()
+	defer os.RemoveAll(filepath.Dir(root))
+	defer os.RemoveAll(outside)
+
+	for _, test := range resolveTests {
+		resolver := ftp_path.NewResolver(root, test.followSymlinks)
+		virtual, host, err := resolver.Resolve(test.cwd, test.input)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if virtual != test.expectedVirtual {
+			t.Errorf("Error actual = %v, and Expected = %v.", virtual, test.expectedVirtual)
+		}
+		expectedHost := ""
+		if test.expectedErr == nil {
+			expectedHost = filepath.Join(root, test.expectedVirtual)
+		}
+		if host != expectedHost {
+			t.Errorf("Error actual = %v, and Expected = %v.", host, expectedHost)
+		}
+	}
+}
+
+// initDirs creates a root directory containing symlinks that point both inside and outside of it.
+func initDirs() (string, string) {
+	base, err := ioutil.TempDir("", "ftp_path")
+	if err != nil {
+		log.Fatal(err)
+	}
+	outside, err := ioutil.TempDir("", "ftp_path_outside")
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	for _, dir := range []string{root, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("Hello, World!"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "file"), []byte("Secret"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	links := []struct {
+		target string
+		name   string
+	}{
+		{filepath.Join(root, "sub"), "in"},
+		{outside, "out"},
+		{"out", "chain_middle"},
+		{"chain_middle", "chain_out"},
+		{"in", "chain_in"},
+		{filepath.Join(outside, "missing"), "dangling"},
+	}
+	for _, link := range links {
+		if err := os.Symlink(link.target, filepath.Join(root, link.name)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestMounts(t *testing.T) {
+	root, outside := initDirs()
+	defer os.RemoveAll(filepath.Dir(root))
+	defer os.RemoveAll(outside)
+	resolver := ftp_path.NewResolver(root, false,
+		ftp_path.Mount{Path: "/releases", Root: outside, ReadOnly: true},
+		ftp_path.Mount{Path: "/releases/nested", Root: filepath.Join(root, "sub")},
+		ftp_path.Mount{Path: "/data/", Root: outside},
+	)
+
+	var tests = []struct {
+		cwd             string
+		input           string
+		expectedVirtual string
+		expectedHost    string
+		expectedErr     error
+		writable        bool
+	}{
+		{"/", "releases/file", "/releases/file", filepath.Join(outside, "file"), nil, false},
+		{"/", "releases", "/releases", outside, nil, false},
+		{"/releases", "..", "/", root, nil, true},
+		{"/releases", "../../releases/file", "/releases/file", filepath.Join(outside, "file"), nil, false},
+		{"/releases", "nested/file", "/releases/nested/file", filepath.Join(root, "sub", "file"), nil, true},
+		{"/releases/nested", "..", "/releases", outside, nil, false},
+		{"/", "data", "/data", outside, nil, false},
+		{"/data", "new_file", "/data/new_file", filepath.Join(outside, "new_file"), nil, true},
+		{"/", "releasesX", "/releasesX", filepath.Join(root, "releasesX"), nil, true},
+		{"/releases", "../out", "", "", errors.New("Invalid path /out"), false},
+	}
+	for _, test := range tests {
+		virtual, host, err := resolver.Resolve(test.cwd, test.input)
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if virtual != test.expectedVirtual {
+			t.Errorf("Error actual = %v, and Expected = %v.", virtual, test.expectedVirtual)
+		}
+		if host != test.expectedHost {
+			t.Errorf("Error actual = %v, and Expected = %v.", host, test.expectedHost)
+		}
+		if err == nil && resolver.Writable(virtual) != test.writable {
+			t.Errorf("Error actual = %v, and Expected = %v.", !test.writable, test.writable)
+		}
+	}
+
+	var mountsInTests = []struct {
+		dir      string
+		expected []string
+	}{
+		{"/", []string{"/releases", "/data"}},
+		{"/releases", []string{"/releases/nested"}},
+		{"/data", nil},
+	}
+	for _, test := range mountsInTests {
+		var actual []string
+		for _, m := range resolver.MountsIn(test.dir) {
+			actual = append(actual, m.Path)
+		}
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+	}
+}
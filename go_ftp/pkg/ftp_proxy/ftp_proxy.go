@@ -0,0 +1,203 @@
+package ftp_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The signature that starts a PROXY protocol version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2Local     = 0x20
+	v2Proxy     = 0x21
+	v2TCP4      = 0x11
+	v2TCP6      = 0x21
+)
+
+// Conn is a connection accepted from a proxy, RemoteAddr returns the address of the client as reported in
+// the PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+// Trusted is a list of proxies that are allowed to send PROXY protocol headers.
+type Trusted []*net.IPNet
+
+// ParseTrusted parses a list of IP addresses and CIDR networks such as "10.0.0.1" or "10.0.0.0/8".
+func ParseTrusted(proxies ...string) (Trusted, error) {
+	var trusted Trusted
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New("Invalid proxy address " + proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("Invalid proxy address " + proxy)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// Contains reports whether addr is the address of a trusted proxy.
+func (trusted Trusted) Contains(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConn reads the PROXY protocol header, version 1 or 2, that starts conn. The header must be received
+// within timeout. Headers of the LOCAL or UNKNOWN kind, which proxies send for their own health checks,
+// keep the address of the proxy as remote address.
+func NewConn(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	remote, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &Conn{Conn: conn, r: r, remote: remote}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ProxyAddr returns the address of the proxy the connection was accepted from.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// Look at the first byte before peeking further so that clients that don't send a header aren't left
+	// waiting for the timeout.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v2Signature[0]:
+		signature, err := r.Peek(len(v2Signature))
+		if err == nil && bytes.Equal(signature, v2Signature) {
+			return readV2(r)
+		}
+	case v1Prefix[0]:
+		prefix, err := r.Peek(len(v1Prefix))
+		if err == nil && string(prefix) == v1Prefix {
+			return readV1(r)
+		}
+	}
+	return nil, errors.New("Missing PROXY protocol header")
+}
+
+// readV1 reads a header such as "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, errors.New("Invalid PROXY protocol header")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	switch {
+	case ip == nil || net.ParseIP(fields[3]) == nil:
+		return nil, errors.New("Invalid PROXY protocol header")
+	case fields[1] == "TCP4" && ip.To4() == nil, fields[1] == "TCP6" && ip.To4() != nil:
+		return nil, errors.New("Invalid PROXY protocol header")
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return nil, errors.New("Unsupported PROXY protocol family")
+	case err != nil || port < 0 || port > 65535:
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2 reads a binary header: the signature, the version and command, the address family, the length of
+// the rest of the header and the addresses.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	command, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch command {
+	case v2Local:
+		return nil, nil
+	case v2Proxy:
+	default:
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	var ipLen int
+	switch family {
+	case v2TCP4:
+		ipLen = net.IPv4len
+	case v2TCP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, errors.New("Unsupported PROXY protocol family")
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	ip := net.IP(body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
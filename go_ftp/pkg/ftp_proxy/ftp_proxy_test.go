@@ -0,0 +1,89 @@
+package ftp_proxy_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_proxy"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func v2Header(command, family byte, addrs ...byte) string {
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), command, family, 0, byte(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+var headerTests = []struct {
+	input       string
+	expected    string
+	expectedErr error
+}{
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 21\r\nUSER demo\r\n", "192.168.0.1:56324", nil},
+	{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 21\r\nUSER demo\r\n", "[2001:db8::1]:56324", nil},
+	{"PROXY UNKNOWN\r\nUSER demo\r\n", "pipe", nil},
+	{v2Header(0x21, 0x11, 192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0, 21) + "USER demo\r\n", "192.168.0.1:56324", nil},
+	{v2Header(0x21, 0x21, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0xdc, 0x04, 0, 21) + "USER demo\r\n",
+		"[2001:db8::1]:56324", nil},
+	{v2Header(0x20, 0x00) + "USER demo\r\n", "pipe", nil},
+	{"USER demo\r\n", "", errors.New("Missing PROXY protocol header")},
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "", errors.New("Invalid PROXY protocol header")},
+	{"PROXY TCP4 2001:db8::1 2001:db8::2 56324 21\r\n", "", errors.New("Invalid PROXY protocol header")},
+	{"PROXY UDP4 192.168.0.1 192.168.0.11 56324 21\r\n", "", errors.New("Unsupported PROXY protocol family")},
+	{v2Header(0x21, 0x12, 192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0, 21), "", errors.New("Unsupported PROXY protocol family")},
+	{v2Header(0x21, 0x11, 192, 168, 0, 1), "", errors.New("Invalid PROXY protocol header")},
+}
+
+func TestNewConn(t *testing.T) {
+	for _, test := range headerTests {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(test.input))
+			client.Close()
+		}()
+		conn, err := ftp_proxy.NewConn(server, time.Second)
+		if ok, want, have := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if err != nil {
+			server.Close()
+			continue
+		}
+		if conn.RemoteAddr().String() != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", conn.RemoteAddr(), test.expected)
+		}
+		rest, _ := ioutil.ReadAll(conn)
+		if string(rest) != "USER demo\r\n" {
+			t.Errorf("Error actual = %q, and Expected = %q.", rest, "USER demo\r\n")
+		}
+		conn.Close()
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	trusted, err := ftp_proxy.ParseTrusted("10.0.0.1", "192.168.0.0/16", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		input    net.Addr
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.3.4"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}, true},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	}
+	for _, test := range tests {
+		if actual := trusted.Contains(test.input); actual != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+	}
+	if _, err := ftp_proxy.ParseTrusted("10.0.0"); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "Invalid proxy address 10.0.0")
+	}
+}
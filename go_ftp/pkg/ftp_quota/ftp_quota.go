@@ -0,0 +1,261 @@
+package ftp_quota
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// Quota limits the storage of a user. A zero value means unlimited.
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int64
+}
+
+// Usage is the storage currently used by a user.
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// Manager keeps track of the quotas and usage of all users, it is shared between sessions. The usage of a
+// user is the usage of its home directory, files elsewhere, e.g. in mounts, don't count.
+type Manager struct {
+	mu       sync.Mutex
+	quotas   map[string]Quota
+	usage    map[string]*Usage
+	reserved map[string]*Usage
+	homes    map[string]string
+}
+
+// Reservation is the storage reserved for an upload in progress, so that concurrent uploads of the same user
+// are checked against each other. Commit adds it to the usage once the upload is complete.
+type Reservation struct {
+	m        *Manager
+	user     string
+	replaced Usage
+	reserved Usage
+	written  int64
+	counts   bool
+}
+
+// Public Methods
+
+func NewManager() *Manager {
+	return &Manager{
+		quotas:   make(map[string]Quota),
+		usage:    make(map[string]*Usage),
+		reserved: make(map[string]*Usage),
+		homes:    make(map[string]string),
+	}
+}
+
+func (m *Manager) SetQuota(user string, quota Quota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quotas[user] = quota
+}
+
+func (m *Manager) HasQuota(user string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.quotas[user]
+	return ok
+}
+
+// Scan computes the usage of user by walking its home directory. Hidden ".part" files are uploads in
+// progress, they are counted by the reservations of their uploads instead.
+func (m *Manager) Scan(user, home string) error {
+	usage := Usage{}
+	err := filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isPart(info.Name()) {
+			usage.Bytes += info.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage[user] = &usage
+	m.homes[user] = home
+	return nil
+}
+
+// Allows reports whether user can store bytes and files more without exceeding its quota.
+func (m *Manager) Allows(user string, bytes, files int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.allows(user, bytes, files)
+}
+
+// Add updates the usage of user for a change of path, negative values are used when files are removed.
+// Paths outside the scanned home directory of user are ignored.
+func (m *Manager) Add(user, path string, bytes, files int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.counts(user, path) {
+		return
+	}
+	usage := m.getUsage(user)
+	usage.Bytes += bytes
+	usage.Files += files
+}
+
+func (m *Manager) Report(user string) (Quota, Usage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	quota, ok := m.quotas[user]
+	if !ok {
+		return Quota{}, Usage{}, false
+	}
+	return quota, *m.getUsage(user), true
+}
+
+// Reserve reserves a file for an upload of user to path, replaced is the usage of the file that is
+// overwritten, if any. The bytes are reserved as they are written through Writer. Release must be called
+// once the upload is done.
+func (m *Manager) Reserve(user, path string, replaced Usage) (*Reservation, error) {
+	m.mu.Lock()
+	counts := m.counts(user, path)
+	m.mu.Unlock()
+	r := &Reservation{m: m, user: user, replaced: replaced, counts: counts}
+	if err := r.grow(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Writer returns a writer that writes to w as long as the quota of the user allows it.
+func (r *Reservation) Writer(w io.Writer) io.Writer {
+	return &quotaWriter{r: r, w: w}
+}
+
+// Commit adds the written file to the usage of the user and releases the reservation.
+func (r *Reservation) Commit() {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if !r.counts {
+		return
+	}
+	usage := r.m.getUsage(r.user)
+	usage.Bytes += r.written - r.replaced.Bytes
+	usage.Files += 1 - r.replaced.Files
+	r.release()
+}
+
+// Release releases the reservation without changing the usage, it does nothing after Commit.
+func (r *Reservation) Release() {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.release()
+}
+
+// Private Methods
+
+func (m *Manager) allows(user string, bytes, files int64) bool {
+	quota, ok := m.quotas[user]
+	if !ok {
+		return true
+	}
+	usage, reserved := m.getUsage(user), m.getReserved(user)
+	if quota.MaxBytes > 0 && usage.Bytes+reserved.Bytes+bytes > quota.MaxBytes {
+		return false
+	}
+	if quota.MaxFiles > 0 && usage.Files+reserved.Files+files > quota.MaxFiles {
+		return false
+	}
+	return true
+}
+
+// counts reports whether a change of path counts towards the quota of user.
+func (m *Manager) counts(user, path string) bool {
+	if _, ok := m.quotas[user]; !ok {
+		return false
+	}
+	home, ok := m.homes[user]
+	if !ok {
+		return true
+	}
+	rel, err := filepath.Rel(home, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (m *Manager) getUsage(user string) *Usage {
+	usage, ok := m.usage[user]
+	if !ok {
+		usage = &Usage{}
+		m.usage[user] = usage
+	}
+	return usage
+}
+
+func (m *Manager) getReserved(user string) *Usage {
+	reserved, ok := m.reserved[user]
+	if !ok {
+		reserved = &Usage{}
+		m.reserved[user] = reserved
+	}
+	return reserved
+}
+
+// grow reserves the usage of the file once n more bytes are written to it. The check allows a file to be
+// replaced by a smaller one, but only growth is reserved, as the replaced file is in use until the commit.
+func (r *Reservation) grow(n int64) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if !r.counts {
+		r.written += n
+		return nil
+	}
+	bytes, files := r.written+n-r.replaced.Bytes, 1-r.replaced.Files
+	if !r.m.allows(r.user, bytes-r.reserved.Bytes, files-r.reserved.Files) {
+		return &ftp_error.QuotaExceededError{User: r.user}
+	}
+	reserved := r.m.getReserved(r.user)
+	r.release()
+	r.reserved = Usage{Bytes: max(bytes, 0), Files: max(files, 0)}
+	reserved.Bytes += r.reserved.Bytes
+	reserved.Files += r.reserved.Files
+	r.written += n
+	return nil
+}
+
+func (r *Reservation) release() {
+	reserved := r.m.getReserved(r.user)
+	reserved.Bytes -= r.reserved.Bytes
+	reserved.Files -= r.reserved.Files
+	r.reserved = Usage{}
+}
+
+func isPart(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part")
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type quotaWriter struct {
+	r *Reservation
+	w io.Writer
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if err := qw.r.grow(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return qw.w.Write(p)
+}
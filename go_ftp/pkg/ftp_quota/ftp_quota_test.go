@@ -0,0 +1,174 @@
+package ftp_quota_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_quota"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func TestScan(t *testing.T) {
+	home, err := ioutil.TempDir("", "ftp_quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if err := os.Mkdir(filepath.Join(home, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// The hidden .part file is an upload in progress.
+	for name, content := range map[string]string{"a": "Hello", "dir/b": "abc", "dir/empty": "", "dir/.c.123.part": "abc"} {
+		if err := ioutil.WriteFile(filepath.Join(home, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := ftp_quota.NewManager()
+	m.SetQuota("user", ftp_quota.Quota{MaxBytes: 10})
+	if err := m.Scan("user", home); err != nil {
+		t.Fatal(err)
+	}
+	_, usage, ok := m.Report("user")
+	expected := ftp_quota.Usage{Bytes: 8, Files: 3}
+	if !ok || usage != expected {
+		t.Errorf("Error actual = %v, and Expected = %v.", usage, expected)
+	}
+	if err := m.Scan("user", filepath.Join(home, "missing")); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "error")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	m := ftp_quota.NewManager()
+	m.SetQuota("user", ftp_quota.Quota{MaxBytes: 10})
+	home, err := ioutil.TempDir("", "ftp_quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if err := m.Scan("user", home); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path     string
+		bytes    int64
+		files    int64
+		expected ftp_quota.Usage
+	}{
+		{filepath.Join(home, "a"), 5, 1, ftp_quota.Usage{Bytes: 5, Files: 1}},
+		{filepath.Join(home, "dir", "b"), 3, 1, ftp_quota.Usage{Bytes: 8, Files: 2}},
+		// Files outside the home directory, e.g. in mounts, don't count.
+		{filepath.Join(filepath.Dir(home), "other"), 3, 1, ftp_quota.Usage{Bytes: 8, Files: 2}},
+		{home + "-other", 3, 1, ftp_quota.Usage{Bytes: 8, Files: 2}},
+		{filepath.Join(home, "a"), -5, -1, ftp_quota.Usage{Bytes: 3, Files: 1}},
+	}
+	for _, test := range tests {
+		m.Add("user", test.path, test.bytes, test.files)
+		if _, usage, _ := m.Report("user"); usage != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", usage, test.expected)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	m := ftp_quota.NewManager()
+	m.SetQuota("user", ftp_quota.Quota{MaxBytes: 10, MaxFiles: 2})
+	m.Add("user", "/home/user/a", 6, 1)
+	m.Add("other", "/home/other/a", 100, 100)
+
+	var tests = []struct {
+		user     string
+		bytes    int64
+		files    int64
+		expected bool
+	}{
+		{"user", 4, 1, true},
+		{"user", 5, 0, false},
+		{"user", 0, 2, false},
+		{"other", 1000, 1000, true},
+	}
+	for _, test := range tests {
+		if actual := m.Allows(test.user, test.bytes, test.files); actual != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", actual, test.expected)
+		}
+	}
+	if _, usage, ok := m.Report("other"); ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", usage, "no quota")
+	}
+}
+
+func TestReservation(t *testing.T) {
+	m := ftp_quota.NewManager()
+	m.SetQuota("user", ftp_quota.Quota{MaxBytes: 10})
+	m.Add("user", "/home/user/a", 8, 2)
+
+	var tests = []struct {
+		replaced    ftp_quota.Usage
+		data        string
+		expected    string
+		expectedErr error
+	}{
+		{ftp_quota.Usage{}, "ab", "ab", nil},
+		{ftp_quota.Usage{}, "abc", "", &ftp_error.QuotaExceededError{User: "user"}},
+		{ftp_quota.Usage{Bytes: 5, Files: 1}, "1234567", "1234567", nil},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		r, err := m.Reserve("user", "/home/user/b", test.replaced)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Writer(&buf).Write([]byte(test.data))
+		if ok, have, want := test_utils.VerifyError(err, test.expectedErr); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", buf.String(), test.expected)
+		}
+		r.Release()
+	}
+	if _, usage, _ := m.Report("user"); usage != (ftp_quota.Usage{Bytes: 8, Files: 2}) {
+		t.Errorf("Error actual = %v, and Expected = %v.", usage, ftp_quota.Usage{Bytes: 8, Files: 2})
+	}
+}
+
+func TestConcurrentReservations(t *testing.T) {
+	m := ftp_quota.NewManager()
+	m.SetQuota("user", ftp_quota.Quota{MaxBytes: 10, MaxFiles: 3})
+	m.Add("user", "/home/user/a", 4, 1)
+
+	first, err := m.Reserve("user", "/home/user/b", ftp_quota.Usage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Reserve("user", "/home/user/c", ftp_quota.Usage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both uploads fit on their own, but not together.
+	if _, err := first.Writer(ioutil.Discard).Write([]byte("1234")); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+	_, err = second.Writer(ioutil.Discard).Write([]byte("1234"))
+	if ok, have, want := test_utils.VerifyError(err, &ftp_error.QuotaExceededError{User: "user"}); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	// The files of the uploads are reserved too.
+	if _, err := m.Reserve("user", "/home/user/d", ftp_quota.Usage{}); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "error")
+	}
+	first.Commit()
+	second.Release()
+	first.Release()
+	if _, usage, _ := m.Report("user"); usage != (ftp_quota.Usage{Bytes: 8, Files: 2}) {
+		t.Errorf("Error actual = %v, and Expected = %v.", usage, ftp_quota.Usage{Bytes: 8, Files: 2})
+	}
+	if !m.Allows("user", 2, 1) || m.Allows("user", 3, 0) {
+		t.Errorf("Error actual = %v, and Expected = %v.", m.Allows("user", 2, 1), true)
+	}
+}
@@ -0,0 +1,146 @@
+package ftp_record
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+)
+
+// Direction tells who sent a line of a transcript.
+type Direction byte
+
+const (
+	Command Direction = '>'
+	Reply   Direction = '<'
+)
+
+// Redacted replaces the argument of PASS commands in transcripts.
+const Redacted = "****"
+
+// Entry is a line of a transcript, e.g. "2020-01-02T15:04:05.123Z > USER demo".
+type Entry struct {
+	Time time.Time
+	Dir  Direction
+	Line string
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %c %s", e.Time.Format(time.RFC3339Nano), e.Dir, e.Line)
+}
+
+// Conn is a control connection that records everything that passes through it.
+type Conn struct {
+	net.Conn
+	mu      sync.Mutex
+	w       io.WriteCloser
+	partial [2][]byte
+}
+
+// Public Methods
+
+// NewConn records the control connection conn as a transcript written to w, which is closed with conn.
+func NewConn(conn net.Conn, w io.WriteCloser) *Conn {
+	return &Conn{Conn: conn, w: w}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(Command, b[:n])
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(Reply, b[:n])
+	return n, err
+}
+
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w != nil {
+		c.w.Close()
+		c.w = nil
+	}
+	return err
+}
+
+// ParseTranscript reads a transcript written by Conn.
+func ParseTranscript(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		components := strings.SplitN(scanner.Text(), " ", 3)
+		if len(components) < 2 || len(components[1]) != 1 {
+			return nil, fmt.Errorf("Invalid transcript line: %s", scanner.Text())
+		}
+		t, err := time.Parse(time.RFC3339Nano, components[0])
+		if err != nil {
+			return nil, err
+		}
+		dir := Direction(components[1][0])
+		if dir != Command && dir != Reply {
+			return nil, fmt.Errorf("Invalid transcript line: %s", scanner.Text())
+		}
+		line := ""
+		if len(components) == 3 {
+			line = components[2]
+		}
+		entries = append(entries, Entry{Time: t, Dir: dir, Line: line})
+	}
+	return entries, scanner.Err()
+}
+
+// Private Methods
+
+func (c *Conn) record(dir Direction, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return
+	}
+	i := 0
+	if dir == Reply {
+		i = 1
+	}
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '\n')
+		part := b
+		if end >= 0 {
+			part = b[:end]
+		}
+		// Like the command scanner, only the start of lines that are too long is kept.
+		if room := ftp_cmd.MaxLineLength - len(c.partial[i]); len(part) > room {
+			part = part[:room]
+		}
+		c.partial[i] = append(c.partial[i], part...)
+		if end < 0 {
+			return
+		}
+		line := strings.TrimRight(string(c.partial[i]), "\r")
+		c.partial[i] = c.partial[i][:0]
+		b = b[end+1:]
+		if dir == Command {
+			line = redact(line)
+		}
+		fmt.Fprintln(c.w, Entry{Time: time.Now().UTC(), Dir: dir, Line: line})
+	}
+}
+
+// redact hides the password of PASS commands. The line is parsed like the server does, so that PASS
+// commands preceded by control characters or Telnet sequences are redacted too.
+func redact(line string) string {
+	cmd, err := ftp_cmd.NewScanner(strings.NewReader(line + "\n")).NextCommand()
+	if err == nil && cmd.Type == ftp_cmd.PASS {
+		return string(ftp_cmd.PASS) + " " + Redacted
+	}
+	return line
+}
@@ -0,0 +1,180 @@
+package ftp_record_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_record"
+)
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestConn(t *testing.T) {
+	server, client := net.Pipe()
+	transcript := nopCloser{&bytes.Buffer{}}
+	conn := ftp_record.NewConn(server, transcript)
+	go func() {
+		client.Write([]byte("USER demo\r\nPA"))
+		client.Write([]byte("SS secret\r\n"))
+		ioutil.ReadAll(client)
+	}()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Fprintf(conn, "211-Features:\n MODE Z\n211 End\n")
+	conn.Close()
+
+	entries, err := ftp_record.ParseTranscript(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"> USER demo", "> PASS ****", "< 211-Features:", "<  MODE Z", "< 211 End"}
+	var actual []string
+	for _, entry := range entries {
+		actual = append(actual, fmt.Sprintf("%c %s", entry.Dir, entry.Line))
+		if time.Since(entry.Time) > time.Minute {
+			t.Errorf("Error actual = %v, and Expected = %v.", entry.Time, "now")
+		}
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Error actual = %v, and Expected = %v.", actual, expected)
+	}
+}
+
+func TestConnCommands(t *testing.T) {
+	long := strings.Repeat("a", ftp_cmd.MaxLineLength)
+	var tests = []struct {
+		input    string
+		expected []string
+	}{
+		{"pass secret\n", []string{"> PASS ****"}},
+		{"\x00PASS secret\r\n", []string{"> PASS ****"}},
+		{"\tPASS secret\r\n", []string{"> PASS ****"}},
+		{"\xff\xf4\xff\xf2PASS secret\r\n", []string{"> PASS ****"}},
+		{"PASSWORD secret\r\n", []string{"> PASSWORD secret"}},
+		// Only the start of lines that are too long is recorded.
+		{long + "bbbb\r\nUSER demo\r\n", []string{"> " + long, "> USER demo"}},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		transcript := nopCloser{&bytes.Buffer{}}
+		conn := ftp_record.NewConn(server, transcript)
+		go func() {
+			client.Write([]byte(test.input))
+			client.Close()
+		}()
+		ioutil.ReadAll(conn)
+		conn.Close()
+
+		entries, err := ftp_record.ParseTranscript(transcript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for _, entry := range entries {
+			actual = append(actual, fmt.Sprintf("%c %s", entry.Dir, entry.Line))
+		}
+		if strings.Join(actual, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("Error actual = %q, and Expected = %q.", actual, test.expected)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		replies := map[string]string{
+			"USER demo": "331 Password required for demo.\n",
+			"PASS pw":   "230 User logged in.\n",
+			"FEAT":      "211-Features:\n MODE Z\n211 End\n",
+			"PWD":       "257 \"/changed\" is current directory.\n",
+			"PASV":      "227 Entering Passive Mode (127,0,0,1,200,1).\n",
+		}
+		fmt.Fprintf(conn, "220 Service ready.\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			reply, ok := replies[scanner.Text()]
+			if !ok {
+				reply = "530 Login failed.\n"
+			}
+			fmt.Fprint(conn, reply)
+		}
+	}()
+
+	transcript := `2020-01-02T15:04:05Z < 220 Service ready.
+2020-01-02T15:04:05Z > USER demo
+2020-01-02T15:04:05Z < 331 Password required for demo.
+2020-01-02T15:04:05Z > PASS ****
+2020-01-02T15:04:05Z < 230 User logged in.
+2020-01-02T15:04:05Z > FEAT
+2020-01-02T15:04:05Z < 211-Features:
+2020-01-02T15:04:05Z <  MODE Z
+2020-01-02T15:04:05Z < 211 End
+2020-01-02T15:04:05Z > PASV
+2020-01-02T15:04:05Z < 227 Entering Passive Mode (127,0,0,1,100,1).
+2020-01-02T15:04:05Z > PWD
+2020-01-02T15:04:05Z < 257 "/" is current directory.
+`
+	entries, err := ftp_record.ParseTranscript(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	diffs, err := ftp_record.Replay(conn, entries, "pw", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ftp_record.Diff{
+		{Command: "PWD", Expected: []string{`257 "/" is current directory.`}, Actual: []string{`257 "/changed" is current directory.`}},
+	}
+	if fmt.Sprint(diffs) != fmt.Sprint(expected) {
+		t.Errorf("Error actual = %v, and Expected = %v.", diffs, expected)
+	}
+}
+
+func TestParseTranscript(t *testing.T) {
+	var tests = []struct {
+		input string
+		valid bool
+	}{
+		{"2020-01-02T15:04:05Z > NOOP\n", true},
+		{"2020-01-02T15:04:05.123456789Z < 200 OK\n", true},
+		{"2020-01-02 > NOOP\n", false},
+		{"2020-01-02T15:04:05Z ? NOOP\n", false},
+		{"NOOP\n", false},
+	}
+	for _, test := range tests {
+		_, err := ftp_record.ParseTranscript(strings.NewReader(test.input))
+		if (err == nil) != test.valid {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package ftp_record
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
+)
+
+// Step is a command of a transcript and the reply lines it got. The first step of a transcript has no
+// command, its replies are the welcome message.
+type Step struct {
+	Command string
+	Replies []string
+}
+
+// Diff is a step whose replies differ between the transcript and the replay.
+type Diff struct {
+	Command  string
+	Expected []string
+	Actual   []string
+}
+
+var (
+	finalLine = regexp.MustCompile(`^\d{3}( |$)`)
+	epsvPort  = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+)
+
+// Public Methods
+
+// Steps groups the entries of a transcript by command.
+func Steps(entries []Entry) []Step {
+	steps := []Step{{}}
+	for _, entry := range entries {
+		if entry.Dir == Command {
+			steps = append(steps, Step{Command: entry.Line})
+			continue
+		}
+		last := &steps[len(steps)-1]
+		last.Replies = append(last.Replies, entry.Line)
+	}
+	return steps
+}
+
+// Replay sends the commands of a transcript to the server at the other end of conn and returns the steps
+// whose replies differ. Redacted passwords are replaced by password. The data connections of passive mode
+// transfers are opened, uploads send no data and downloads are discarded. The text of PASV and EPSV replies
+// is ignored as it changes between sessions. Each reply must arrive within timeout.
+func Replay(conn net.Conn, entries []Entry, password string, timeout time.Duration) ([]Diff, error) {
+	var diffs []Diff
+	r := bufio.NewReader(conn)
+	for _, step := range Steps(entries) {
+		if step.Command != "" {
+			command := step.Command
+			if strings.EqualFold(command, string(ftp_cmd.PASS)+" "+Redacted) {
+				command = string(ftp_cmd.PASS) + " " + password
+			}
+			if _, err := io.WriteString(conn, command+"\r\n"); err != nil {
+				return diffs, err
+			}
+		}
+		var actual []string
+		for i := 0; i < countReplies(step.Replies); i++ {
+			lines, err := readReply(conn, r, timeout)
+			actual = append(actual, lines...)
+			if err != nil {
+				break
+			}
+			openDataConnection(conn, lines)
+		}
+		if !equal(step.Replies, actual) {
+			diffs = append(diffs, Diff{Command: step.Command, Expected: step.Replies, Actual: actual})
+		}
+	}
+	return diffs, nil
+}
+
+// Private Methods
+
+func countReplies(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if finalLine.MatchString(line) {
+			n++
+		}
+	}
+	return n
+}
+
+// readReply reads a single or multi-line reply.
+func readReply(conn net.Conn, r *bufio.Reader, timeout time.Duration) ([]string, error) {
+	var lines []string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return lines, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if finalLine.MatchString(line) && (len(lines) == 1 || line[:3] == lines[0][:3]) {
+			return lines, nil
+		}
+	}
+}
+
+// openDataConnection connects to the address of a PASV or EPSV reply and discards everything received.
+func openDataConnection(conn net.Conn, reply []string) {
+	if len(reply) != 1 {
+		return
+	}
+	var addr string
+	switch {
+	case strings.HasPrefix(reply[0], "227 "):
+		addr, _ = ftp_ip.Decode(reply[0])
+	case strings.HasPrefix(reply[0], "229 "):
+		if match := epsvPort.FindStringSubmatch(reply[0]); match != nil {
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			addr = net.JoinHostPort(host, match[1])
+		}
+	}
+	if addr == "" {
+		return
+	}
+	dataConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	go func() {
+		defer dataConn.Close()
+		if tcpConn, ok := dataConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		io.Copy(ioutil.Discard, dataConn)
+	}()
+}
+
+func equal(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if normalize(expected[i]) != normalize(actual[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalize(line string) string {
+	if strings.HasPrefix(line, "227 ") || strings.HasPrefix(line, "229 ") {
+		return line[:3]
+	}
+	return line
+}
@@ -0,0 +1,75 @@
+package client_connection
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+)
+
+// The languages supported by LANG (RFC 2640), the first one is the default.
+var languages = []string{"EN"}
+
+// SetFallbackCharset sets the charset used for clients that don't enable UTF-8 with "OPTS UTF8 ON". Path
+// arguments that aren't valid UTF-8 are decoded from it and replies and listings are encoded in it. Without
+// a fallback charset everything is UTF-8 and invalid arguments are rejected.
+func (cc *ClientConnection) SetFallbackCharset(charset encoding.Encoding) {
+	cc.charset = charset
+}
+
+// Private Methods
+
+// decodeArg converts the path argument of cmd to normalized UTF-8.
+func (cc *ClientConnection) decodeArg(cmd *ftp_cmd.Cmd) error {
+	if spec, _ := ftp_cmd.Lookup(cmd.Type); !spec.Path {
+		return nil
+	}
+	arg, err := ftp_charset.Decode(cmd.Arg, cc.legacyCharset())
+	if err != nil {
+		return err
+	}
+	cmd.Arg = arg
+	return nil
+}
+
+// legacyCharset returns the charset used with the client, or nil for UTF-8.
+func (cc *ClientConnection) legacyCharset() encoding.Encoding {
+	if cc.utf8 {
+		return nil
+	}
+	return cc.charset
+}
+
+// handleOptsUtf8CMD handles "OPTS UTF8 ON" and "OPTS UTF8 OFF".
+func (cc *ClientConnection) handleOptsUtf8CMD(args []string) error {
+	if len(args) != 1 {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		cc.utf8 = true
+	case "OFF":
+		cc.utf8 = false
+	default:
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	return cc.send(200, fmt.Sprintf("UTF8 set to %s.", strings.ToLower(args[0])))
+}
+
+// handleLangCMD handles LANG, which selects the language of the replies. Without argument the default
+// language is selected.
+func (cc *ClientConnection) handleLangCMD(cmd *ftp_cmd.Cmd) error {
+	if cmd.Arg == "" {
+		return cc.send(200, fmt.Sprintf("Language set to %s.", languages[0]))
+	}
+	tag := strings.ToUpper(strings.TrimSpace(cmd.Arg))
+	for _, lang := range languages {
+		if tag == lang || strings.HasPrefix(tag, lang+"-") {
+			return cc.send(200, fmt.Sprintf("Language set to %s.", lang))
+		}
+	}
+	return cc.send(504, "Unsupported language.")
+}
@@ -1,6 +1,8 @@
 package client_connection
 
 import (
+	"compress/zlib"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,11 +12,22 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"golang.org/x/text/encoding"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_filter"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hash"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hooks"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_lock"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_quota"
 )
 
 type ClientConnection struct {
@@ -27,6 +40,30 @@ type ClientConnection struct {
 	ctrlConnScanner *ftp_cmd.Scanner
 	authCh          chan AuthPkg
 	mode            ftp_cmd.MODE
+	hooks           ftp_hooks.Hooks
+	quota           *ftp_quota.Manager
+	renameFrom      string
+	hashAlgo        ftp_hash.Algorithm
+	compress        bool
+	compressLevel   int
+	fxpUsers        map[string]bool
+	verifyPassiveIP bool
+	maintenance     func() bool
+	locks           *ftp_lock.Locker
+	status          sessionStatus
+	handlers        map[ftp_cmd.CmdType]Handler
+	siteHandlers    map[string]Handler
+	admins          map[string]bool
+	sessions        func() []Status
+	utf8            bool
+	charset         encoding.Encoding
+	hosts           map[string]VirtualHost
+	host            string
+	certUser        string
+	tlsConfig       *tls.Config
+	pbsz            bool
+	protect         bool
+	uploadFilter    *ftp_filter.Filter
 }
 
 type dataConnection struct {
@@ -37,15 +74,41 @@ type dataConnection struct {
 }
 
 type AuthPkg struct {
-	User     string
-	Password string
-	ReplyCh  chan bool
+	User       string
+	Password   string
+	RemoteAddr string
+	// Host is the virtual host selected with HOST, or empty for the default host.
+	Host string
+	// Certificate is set if User was verified by a TLS client certificate, Password is empty then.
+	Certificate bool
+	ReplyCh     chan AuthReply
+}
+
+// AuthReply is the answer to an AuthPkg.
+type AuthReply struct {
+	OK bool
+	// Home replaces the root directory of the session if it isn't empty, relative paths are relative to the
+	// root directory.
+	Home     string
+	ReadOnly bool
 }
 
+// dataPackage is a request to the goroutine serving a data connection to read ('r'), write ('w') or
+// close ('c') it. The transfer mode is the one in effect at the transfer command.
 type dataPackage struct {
-	action  byte
-	payload []byte
-	reply   chan int
+	action   byte
+	payload  []byte
+	compress bool
+	level    int
+	// tlsConfig protects the data connection with TLS if it isn't nil.
+	tlsConfig *tls.Config
+	reply     chan dataResult
+}
+
+// dataResult is the result of a dataPackage, a read of zero bytes without error means end of file.
+type dataResult struct {
+	n   int
+	err error
 }
 
 // Public Methods
@@ -56,22 +119,109 @@ func New(conn io.ReadWriter, authCh chan AuthPkg, root, ip string) *ClientConnec
 		ctrlConn:        conn,
 		ctrlConnScanner: ftp_cmd.NewScanner(conn),
 		authCh:          authCh,
-		dirPath:         ftpDirPath{root, "/"},
+		dirPath:         ftpDirPath{ftp_path.NewResolver(root, false), "/"},
 		dataConn:        dataConnection{mode: ftp_cmd.PASSIVE},
 		ip:              ip,
+		hooks:           ftp_hooks.NopHooks{},
+		quota:           ftp_quota.NewManager(),
+		locks:           ftp_lock.NewManager(ftp_lock.Reject, 0).NewLocker(),
+		hashAlgo:        ftp_hash.Algorithms[0],
+		compressLevel:   zlib.DefaultCompression,
+		verifyPassiveIP: true,
+		status:          sessionStatus{cwd: "/", lastActive: time.Now()},
 	}
 }
 
+func (cc *ClientConnection) SetHooks(hooks ftp_hooks.Hooks) {
+	cc.hooks = hooks
+}
+
+// SetFollowSymlinks controls whether symlinks pointing outside of the root directory are followed.
+func (cc *ClientConnection) SetFollowSymlinks(follow bool) {
+	resolver := cc.dirPath.resolver
+	cc.dirPath.resolver = ftp_path.NewResolver(resolver.Root(), follow, resolver.Mounts()...)
+}
+
+// SetMounts maps virtual directories to other host directories than the root.
+func (cc *ClientConnection) SetMounts(mounts []ftp_path.Mount) {
+	resolver := cc.dirPath.resolver
+	cc.dirPath.resolver = ftp_path.NewResolver(resolver.Root(), resolver.FollowSymlinks(), mounts...)
+}
+
+// SetCertificateUser sets the user that the verified TLS client certificate of the connection maps to. USER
+// with that name sends an AuthPkg with Certificate set and logs in without PASS if it's accepted.
+func (cc *ClientConnection) SetCertificateUser(user string) {
+	cc.certUser = user
+}
+
+// SetUploadFilter sets the rules that the names and sizes of uploads must follow.
+func (cc *ClientConnection) SetUploadFilter(filter *ftp_filter.Filter) {
+	cc.uploadFilter = filter
+}
+
+// SetFXPUsers sets the users which are allowed to open data connections to other hosts than their own,
+// which is required for server to server (FXP) transfers.
+func (cc *ClientConnection) SetFXPUsers(users map[string]bool) {
+	cc.fxpUsers = users
+}
+
+// SetVerifyPassiveIP controls whether passive data connections must come from the same IP as the
+// control connection. It is enabled by default. TLS protected data connections (PROT P) aren't checked for
+// TLS session reuse, the source IP is the only check.
+func (cc *ClientConnection) SetVerifyPassiveIP(verify bool) {
+	cc.verifyPassiveIP = verify
+}
+
+// SetMaintenance sets a function that reports whether the server is in maintenance mode, logins are
+// refused with 421 while it returns true.
+func (cc *ClientConnection) SetMaintenance(maintenance func() bool) {
+	cc.maintenance = maintenance
+}
+
+// SetLockManager sets the manager that coordinates file access with the other sessions of the server.
+func (cc *ClientConnection) SetLockManager(locks *ftp_lock.Manager) {
+	cc.locks = locks.NewLocker()
+}
+
+func (cc *ClientConnection) SetQuotaManager(quota *ftp_quota.Manager) {
+	cc.quota = quota
+}
+
+func (cc *ClientConnection) Session() ftp_hooks.Session {
+	return ftp_hooks.Session{User: cc.user, RemoteAddr: cc.remoteAddr()}
+}
+
+// Command reads the next command. Invalid command lines are answered with an error reply and skipped, the
+// returned error means that the control connection can't be used anymore.
 func (cc *ClientConnection) Command() (*ftp_cmd.Cmd, error) {
-	cmd, err := cc.ctrlConnScanner.NextCommand()
-	if err != nil {
-		return nil, err
+	for {
+		cmd, err := cc.ctrlConnScanner.NextCommand()
+		if err == nil {
+			err = cc.decodeArg(cmd)
+		}
+		if _, ok := err.(ftp_error.ReplyError); ok {
+			if err := cc.sendError(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return cmd, nil
 	}
-	return cmd, nil
 }
 
 func (cc *ClientConnection) Reply(cmd *ftp_cmd.Cmd) error {
 	log.Printf("Replying to cmd %s, arg: %s.\n", cmd.Type, cmd.Arg)
+	cc.status.begin(cmd)
+	defer func() {
+		user := ""
+		if cc.isAuth {
+			user = cc.user
+		}
+		cc.status.end(user, cc.dirPath.current)
+	}()
 	if !cc.isAuth && cc.needAuth(cmd) {
 		err := cc.send(530, "Please login with USER and PASS.")
 		return err
@@ -95,12 +245,46 @@ func (cc *ClientConnection) Reply(cmd *ftp_cmd.Cmd) error {
 		err = cc.handlePasvCMD(cmd)
 	case ftp_cmd.PORT:
 		err = cc.handlePortCMD(cmd)
+	case ftp_cmd.EPRT:
+		err = cc.handleEprtCMD(cmd)
 	case ftp_cmd.RETR:
 		err = cc.handleRetrCMD(cmd)
 	case ftp_cmd.DELE:
 		err = cc.handleDeleCMD(cmd)
 	case ftp_cmd.STOR:
 		err = cc.handleStorCMD(cmd)
+	case ftp_cmd.STOU:
+		err = cc.handleStouCMD(cmd)
+	case ftp_cmd.RNFR:
+		err = cc.handleRnfrCMD(cmd)
+	case ftp_cmd.RNTO:
+		err = cc.handleRntoCMD(cmd)
+	case ftp_cmd.SITE:
+		err = cc.handleSiteCMD(cmd)
+	case ftp_cmd.MODE_CMD:
+		err = cc.handleModeCMD(cmd)
+	case ftp_cmd.FEAT:
+		err = cc.handleFeatCMD(cmd)
+	case ftp_cmd.OPTS:
+		err = cc.handleOptsCMD(cmd)
+	case ftp_cmd.HASH:
+		err = cc.handleHashCMD(cmd)
+	case ftp_cmd.XMD5:
+		err = cc.handleLegacyHashCMD(cmd, ftp_hash.MD5)
+	case ftp_cmd.XSHA1:
+		err = cc.handleLegacyHashCMD(cmd, ftp_hash.SHA1)
+	case ftp_cmd.XSHA256:
+		err = cc.handleLegacyHashCMD(cmd, ftp_hash.SHA256)
+	case ftp_cmd.XCRC:
+		err = cc.handleLegacyHashCMD(cmd, ftp_hash.CRC32)
+	case ftp_cmd.LANG:
+		err = cc.handleLangCMD(cmd)
+	case ftp_cmd.HOST:
+		err = cc.handleHostCMD(cmd)
+	case ftp_cmd.PBSZ:
+		err = cc.handlePbszCMD(cmd)
+	case ftp_cmd.PROT:
+		err = cc.handleProtCMD(cmd)
 	case ftp_cmd.TYPE:
 		err = cc.notImplementedError(cmd)
 	case ftp_cmd.QUIT:
@@ -109,7 +293,11 @@ func (cc *ClientConnection) Reply(cmd *ftp_cmd.Cmd) error {
 			conn.Close()
 		}
 	default:
-		err = cc.send(500, fmt.Sprintf("'%s': command not understood.", cmd.Type))
+		if handler, ok := cc.handlers[cmd.Type]; ok {
+			err = handler(&Context{cc}, cmd)
+		} else {
+			err = cc.send(500, fmt.Sprintf("'%s': command not understood.", cmd.Type))
+		}
 	}
 	return err
 }
@@ -125,107 +313,429 @@ func (cc *ClientConnection) handleDeleCMD(cmd *ftp_cmd.Cmd) error {
 	if err != nil {
 		return cc.send(550, "File not found.")
 	}
+	if !cc.dirPath.writable(cmd.Arg) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: cmd.Arg})
+	}
+	release, err := cc.locks.Remove(filepath)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	defer release()
+	size, files := fileUsage(filepath)
 	if err := os.Remove(filepath); err != nil {
-		return err
+		return cc.sendError(&ftp_error.FileUnavailableError{File: filepath, Err: err})
 	}
-	return cc.send(200, "DELE command successful.")
+	cc.quota.Add(cc.user, filepath, -size, -files)
+	cc.hooks.OnDelete(cc.Session(), filepath)
+	return cc.send(250, "DELE command successful.")
 
 }
 
 func (cc *ClientConnection) handleStorCMD(cmd *ftp_cmd.Cmd) error {
-	filePath := filepath.Join(cc.dirPath.path(), cmd.Arg)
-	wait := make(chan struct{})
-	cc.connectToDataConnection(func(ch chan dataPackage) {
-		wait <- struct{}{}
-		reply := make(chan int)
-		buf := make([]byte, 8196)
-		ch <- dataPackage{action: 'r', payload: buf, reply: reply}
-		n := <-reply
-		if err := ioutil.WriteFile(filePath, buf[:n], 0644); err != nil {
-			log.Fatal(err)
+	filePath, err := cc.getFilePath(cmd.Arg)
+	if err != nil {
+		return cc.send(553, "Requested action not taken. File name not allowed.")
+	}
+	if !cc.dirPath.writable(cmd.Arg) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: cmd.Arg})
+	}
+	maxSize, err := cc.checkUpload(cmd.Arg)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	if err := cc.hooks.BeforeUpload(cc.Session(), filePath); err != nil {
+		return cc.sendVeto(err)
+	}
+	return cc.store(filePath, "Opening ASCII mode data connection for file.", maxSize)
+}
+
+// handleStouCMD stores the upload under a unique name in the current directory.
+func (cc *ClientConnection) handleStouCMD(cmd *ftp_cmd.Cmd) error {
+	name, err := uniqueName(cc.dirPath.path())
+	if err != nil {
+		return cc.sendError(&ftp_error.LocalError{Err: err})
+	}
+	filePath, err := cc.getFilePath(name)
+	if err != nil {
+		return cc.send(553, "Requested action not taken. File name not allowed.")
+	}
+	if !cc.dirPath.writable(name) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: name})
+	}
+	maxSize, err := cc.checkUpload(name)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	if err := cc.hooks.BeforeUpload(cc.Session(), filePath); err != nil {
+		return cc.sendVeto(err)
+	}
+	return cc.store(filePath, "FILE: "+name, maxSize)
+}
+
+// store receives a file into a hidden temporary file in the same directory and renames it to filePath once
+// the transfer is complete, so that other clients never see partial uploads. Uploads larger than maxSize
+// are aborted, zero means unlimited.
+func (cc *ClientConnection) store(filePath, msg string, maxSize int64) error {
+	release, err := cc.locks.Write(filePath)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	defer release()
+	oldSize, oldFiles := fileUsage(filePath)
+	reservation, err := cc.quota.Reserve(cc.user, filePath, ftp_quota.Usage{Bytes: oldSize, Files: oldFiles})
+	if err != nil {
+		return cc.sendError(err)
+	}
+	defer reservation.Release()
+	var size int64
+	tmpPath := ""
+	err = cc.transfer(msg, func(t *dataTransfer) error {
+		file, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.part")
+		if err != nil {
+			return &ftp_error.FileUnavailableError{File: filePath, Err: err}
+		}
+		tmpPath = file.Name()
+		defer file.Close()
+		if err := file.Chmod(0644); err != nil {
+			return &ftp_error.LocalError{Err: err}
+		}
+		w := ftp_filter.LimitWriter(reservation.Writer(file), maxSize, filePath)
+		if size, err = io.Copy(w, t); err != nil {
+			return err
 		}
-		wait <- struct{}{}
+		return file.Close()
 	})
-	<-wait
-	if err := cc.send(150, "Opening ASCII mode data connection for file."); err != nil {
-		return err
+	if err == nil {
+		if err = os.Rename(tmpPath, filePath); err != nil {
+			err = &ftp_error.FileUnavailableError{File: filePath, Err: err}
+		}
 	}
-	<-wait
+	if err != nil {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+		return cc.sendError(err)
+	}
+	reservation.Commit()
+	cc.hooks.AfterUpload(cc.Session(), filePath, size)
 	return cc.send(226, "Transfer complete.")
 }
 
+func (cc *ClientConnection) handleRnfrCMD(cmd *ftp_cmd.Cmd) error {
+	path, err := cc.getFilePathIfExist(cmd.Arg)
+	if err != nil {
+		return cc.send(550, "File not found.")
+	}
+	if !cc.dirPath.writable(cmd.Arg) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: cmd.Arg})
+	}
+	cc.renameFrom = path
+	return cc.send(350, "File exists, ready for destination name.")
+}
+
+func (cc *ClientConnection) handleRntoCMD(cmd *ftp_cmd.Cmd) error {
+	from := cc.renameFrom
+	cc.renameFrom = ""
+	if from == "" {
+		return cc.send(503, "Bad sequence of commands.")
+	}
+	to, err := cc.getFilePath(cmd.Arg)
+	if err != nil {
+		return cc.send(553, "Requested action not taken. File name not allowed.")
+	}
+	if !cc.dirPath.writable(cmd.Arg) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: cmd.Arg})
+	}
+	maxSize, err := cc.checkUpload(cmd.Arg)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	if info, err := os.Stat(from); err == nil && maxSize > 0 && info.Size() > maxSize {
+		return cc.sendError(&ftp_error.FileTooLargeError{File: cmd.Arg, Max: maxSize})
+	}
+	release, err := cc.locks.Remove(from, to)
+	if err != nil {
+		return cc.sendError(err)
+	}
+	defer release()
+	size, files := fileUsage(from)
+	var oldSize, oldFiles int64
+	if to != from {
+		oldSize, oldFiles = fileUsage(to)
+	}
+	if err := os.Rename(from, to); err != nil {
+		return cc.send(550, "Rename failed.")
+	}
+	// The file replaces any file at to, and may have moved between the home directory and a mount.
+	cc.quota.Add(cc.user, from, -size, -files)
+	cc.quota.Add(cc.user, to, size-oldSize, files-oldFiles)
+	cc.hooks.OnRename(cc.Session(), from, to)
+	return cc.send(250, "Rename successful.")
+}
+
+func (cc *ClientConnection) handleFeatCMD(cmd *ftp_cmd.Cmd) error {
+	algos := make([]string, 0, len(ftp_hash.Algorithms))
+	for _, algo := range ftp_hash.Algorithms {
+		name := string(algo)
+		if algo == cc.hashAlgo {
+			name += "*"
+		}
+		algos = append(algos, name)
+	}
+	features := []string{
+		"HASH " + strings.Join(algos, ";"),
+		"LANG " + strings.Join(languages, ";") + "*",
+		"MODE Z",
+		"UTF8",
+	}
+	if len(cc.hosts) > 0 {
+		features = append([]string{"HOST"}, features...)
+	}
+	if cc.tlsConfig != nil {
+		features = append(features, "PBSZ", "PROT")
+	}
+	return cc.sendMultiline(211, "Features:", features, "End")
+}
+
+func (cc *ClientConnection) handleOptsCMD(cmd *ftp_cmd.Cmd) error {
+	args := strings.Fields(cmd.Arg)
+	if len(args) == 0 {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "HASH":
+		return cc.handleOptsHashCMD(args[1:])
+	case "MODE":
+		return cc.handleOptsModeCMD(args[1:])
+	case "UTF8":
+		return cc.handleOptsUtf8CMD(args[1:])
+	}
+	return cc.send(501, fmt.Sprintf("'OPTS %s': option not understood.", args[0]))
+}
+
+func (cc *ClientConnection) handleOptsHashCMD(args []string) error {
+	if len(args) == 0 {
+		return cc.send(200, string(cc.hashAlgo))
+	}
+	algo, ok := ftp_hash.Parse(args[0])
+	if !ok {
+		return cc.send(501, "Unknown algorithm, current selection not changed.")
+	}
+	cc.hashAlgo = algo
+	return cc.send(200, string(algo))
+}
+
+// handleOptsModeCMD handles "OPTS MODE Z LEVEL n" which sets the compression level used in MODE Z.
+func (cc *ClientConnection) handleOptsModeCMD(args []string) error {
+	if len(args) != 3 || strings.ToUpper(args[0]) != "Z" || strings.ToUpper(args[1]) != "LEVEL" {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	level, err := strconv.Atoi(args[2])
+	if err != nil || level < zlib.NoCompression || level > zlib.BestCompression {
+		return cc.send(501, "Invalid compression level.")
+	}
+	cc.compressLevel = level
+	return cc.send(200, fmt.Sprintf("MODE Z LEVEL set to %d.", level))
+}
+
+// handleModeCMD sets the transfer mode of the following transfers, also of those over a passive connection
+// that is already open.
+func (cc *ClientConnection) handleModeCMD(cmd *ftp_cmd.Cmd) error {
+	switch strings.ToUpper(cmd.Arg) {
+	case "S":
+		cc.compress = false
+	case "Z":
+		cc.compress = true
+	default:
+		return cc.send(504, "Command not implemented for that parameter.")
+	}
+	return cc.send(200, fmt.Sprintf("Mode set to %s.", strings.ToUpper(cmd.Arg)))
+}
+
+func (cc *ClientConnection) handleHashCMD(cmd *ftp_cmd.Cmd) error {
+	path, err := cc.getFilePathIfExist(cmd.Arg)
+	if err != nil {
+		return cc.send(550, "File not found.")
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return cc.send(553, "Not a plain file.")
+	}
+	sum, end, err := ftp_hash.File(path, cc.hashAlgo, 0, -1)
+	if err != nil {
+		return cc.send(450, "Requested file action not taken.")
+	}
+	// An empty file has no last byte, its range is reported as 0-0.
+	if end < 0 {
+		end = 0
+	}
+	return cc.send(213, fmt.Sprintf("%s 0-%d %s %s", cc.hashAlgo, end, sum, cmd.Arg))
+}
+
+// handleLegacyHashCMD handles XMD5, XSHA1, XSHA256 and XCRC which take a file name optionally followed
+// by the start and end (inclusive) byte offsets to hash.
+func (cc *ClientConnection) handleLegacyHashCMD(cmd *ftp_cmd.Cmd, algo ftp_hash.Algorithm) error {
+	name, start, end := parseHashRange(cmd.Arg)
+	path, err := cc.getFilePathIfExist(name)
+	if err != nil {
+		return cc.send(550, "File not found.")
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return cc.send(553, "Not a plain file.")
+	}
+	sum, _, err := ftp_hash.File(path, algo, start, end)
+	if err != nil {
+		return cc.send(450, "Requested file action not taken.")
+	}
+	return cc.send(250, sum)
+}
+
 func (cc *ClientConnection) handleUserCMD(cmd *ftp_cmd.Cmd) error {
+	if cc.inMaintenance() {
+		return cc.refuseLogin()
+	}
 	cc.user = cmd.Arg
+	// Certificate logins that are refused, e.g. because the user needs a TOTP code, fall back to PASS.
+	if cc.certUser != "" && cc.user == cc.certUser && cc.login("", true) {
+		cc.hooks.OnLogin(cc.Session(), true)
+		return cc.send(232, "User logged in, authorized by security data exchange.")
+	}
 	return cc.send(331, fmt.Sprintf("Password required for %s.", cc.user))
 }
 
 func (cc *ClientConnection) handlePassCMD(cmd *ftp_cmd.Cmd) error {
-	replyCh := make(chan bool)
-	cc.authCh <- AuthPkg{cc.user, cmd.Arg, replyCh}
-	cc.isAuth = <-replyCh
+	if cc.inMaintenance() {
+		return cc.refuseLogin()
+	}
+	cc.hooks.OnLogin(cc.Session(), cc.login(cmd.Arg, false))
 	if !cc.isAuth {
+		// The client has to start over with USER, or HOST to select another virtual host.
+		cc.user = ""
 		return cc.send(530, "Login failed.")
 	}
 	return cc.send(230, "User logged in.")
 }
 
+// login asks the server to authenticate the user, with password or the client certificate, and applies the
+// account of the user if it succeeds.
+func (cc *ClientConnection) login(password string, certificate bool) bool {
+	replyCh := make(chan AuthReply)
+	cc.authCh <- AuthPkg{cc.user, password, cc.remoteAddr(), cc.host, certificate, replyCh}
+	reply := <-replyCh
+	cc.isAuth = reply.OK && cc.setAccount(reply)
+	if cc.isAuth {
+		// The account has made the home directory of the user the root of the session.
+		cc.scanQuota(cc.dirPath.root())
+	}
+	return cc.isAuth
+}
+
+// scanQuota measures the usage of the user that logged in in its home directory if it has a quota. Only the
+// home is scanned, files of other users elsewhere under the root of the server don't count.
+func (cc *ClientConnection) scanQuota(home string) {
+	if cc.quota.HasQuota(cc.user) {
+		if err := cc.quota.Scan(cc.user, home); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// setAccount applies the home directory and permissions of a successful login. It returns false if the home
+// directory doesn't exist.
+func (cc *ClientConnection) setAccount(reply AuthReply) bool {
+	resolver := cc.dirPath.resolver
+	root, mounts := resolver.Root(), resolver.Mounts()
+	if reply.Home != "" {
+		root = reply.Home
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(resolver.Root(), root)
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			log.Printf("Home directory %s of %s is not a directory.\n", root, cc.user)
+			return false
+		}
+	}
+	// Read-only accounts can't change the mounts either, the innermost mount decides whether a path is
+	// writable.
+	if reply.ReadOnly {
+		readOnly := []ftp_path.Mount{{Path: "/", Root: root, ReadOnly: true}}
+		for _, m := range mounts {
+			m.ReadOnly = true
+			readOnly = append(readOnly, m)
+		}
+		mounts = readOnly
+	}
+	cc.dirPath = ftpDirPath{ftp_path.NewResolver(root, resolver.FollowSymlinks(), mounts...), "/"}
+	return true
+}
+
+func (cc *ClientConnection) inMaintenance() bool {
+	return cc.maintenance != nil && cc.maintenance()
+}
+
+// refuseLogin tells the client that the service is unavailable and closes the connection.
+func (cc *ClientConnection) refuseLogin() error {
+	err := cc.send(421, "Service not available, server is in maintenance mode.")
+	cc.Close()
+	return err
+}
+
 func (cc *ClientConnection) handlePwdCMD(cmd *ftp_cmd.Cmd) error {
 	return cc.send(257, fmt.Sprintf("\"%s\" is current directory.", cc.dirPath.current))
 }
 
 func (cc *ClientConnection) handleCwdCMD(cmd *ftp_cmd.Cmd) error {
-	path, err := cc.getFilePathIfExist(cmd.Arg)
+	virtual, host, err := cc.dirPath.resolve(cmd.Arg)
 	if err != nil {
 		return cc.send(550, "Invalid path.")
 	}
-	p, err := filepath.Rel(cc.dirPath.root, path)
-	if err != nil {
-		log.Fatal(err)
+	if info, err := os.Stat(host); err != nil || !info.IsDir() {
+		return cc.send(550, "Invalid path.")
 	}
-	cc.dirPath.current = filepath.Clean("/" + p)
+	cc.dirPath.current = virtual
 	return cc.send(250, "CWD command successful.")
 }
 
 func (cc *ClientConnection) handleListCMD(cmd *ftp_cmd.Cmd) error {
 	output, err := exec.Command("ls", "-l", cc.dirPath.path()).Output()
 	if err != nil {
-		return err
+		return cc.sendError(&ftp_error.LocalError{Err: err})
 	}
-	wait := make(chan struct{})
-	cc.connectToDataConnection(func(ch chan dataPackage) {
-		wait <- struct{}{}
-		ch <- dataPackage{action: 'w', payload: output}
-		wait <- struct{}{}
-	})
-	<-wait
-	if err := cc.send(150, "Opening ASCII mode data connection for file list."); err != nil {
+	output = append(output, cc.dirPath.listMounts()...)
+	output = []byte(ftp_charset.Encode(string(output), cc.legacyCharset()))
+	err = cc.transfer("Opening ASCII mode data connection for file list.", func(t *dataTransfer) error {
+		_, err := t.Write(output)
 		return err
+	})
+	if err != nil {
+		return cc.sendError(err)
 	}
-	<-wait
 	return cc.send(226, "Transfer complete.")
 }
 
 func (cc *ClientConnection) handleEpsvCMD(cmd *ftp_cmd.Cmd) error {
+	cc.closeDataListener()
 	ch, ln, port, err := cc.openDataListener()
 	if err != nil {
-		return err
+		return cc.sendError(&ftp_error.DataConnectionError{Err: err})
 	}
 	cc.dataConn.ln = ln
 	cc.dataConn.ch = ch
 	cc.dataConn.mode = ftp_cmd.PASSIVE
+	cc.mode = ftp_cmd.PASSIVE
 	return cc.send(229, fmt.Sprintf("Entering Extended Passive Mode (|||%s|)).", port))
 }
 
 func (cc *ClientConnection) handlePasvCMD(cmd *ftp_cmd.Cmd) error {
+	cc.closeDataListener()
 	ch, ln, port, err := cc.openDataListener()
 	if err != nil {
-		return err
+		return cc.sendError(&ftp_error.DataConnectionError{Err: err})
 	}
 	cc.dataConn.ln = ln
 	cc.dataConn.ch = ch
 	encoded, err := ftp_ip.Encode(cc.ip, port)
 	if err != nil {
-		return err
+		return cc.sendError(&ftp_error.LocalError{Err: err})
 	}
 	cc.mode = ftp_cmd.PASSIVE
 	return cc.send(227, fmt.Sprintf("Entering Passive Mode (%s).", encoded))
@@ -234,15 +744,56 @@ func (cc *ClientConnection) handlePasvCMD(cmd *ftp_cmd.Cmd) error {
 func (cc *ClientConnection) handlePortCMD(cmd *ftp_cmd.Cmd) error {
 	addr, err := ftp_ip.Decode(cmd.Arg)
 	if err != nil {
-		return err
+		return cc.send(501, "Syntax error in parameters or arguments.")
 	}
-	if cc.dataConn.ln != nil {
-		cc.dataConn.ln.Close()
-		cc.dataConn.ln = nil
+	if !cc.isDataAddrAllowed(addr) {
+		return cc.send(500, "Illegal PORT command.")
 	}
+	cc.setActiveDataAddr(addr)
+	return cc.send(200, "PORT command successful.")
+}
+
+func (cc *ClientConnection) handleEprtCMD(cmd *ftp_cmd.Cmd) error {
+	addr, err := ftp_ip.DecodeExtended(cmd.Arg)
+	if err != nil {
+		if _, ok := err.(*ftp_ip.UnsupportedProtocolError); ok {
+			return cc.send(522, "Network protocol not supported, use (1,2)")
+		}
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	if !cc.isDataAddrAllowed(addr) {
+		return cc.send(500, "Illegal EPRT command.")
+	}
+	cc.setActiveDataAddr(addr)
+	return cc.send(200, "EPRT command successful.")
+}
+
+func (cc *ClientConnection) setActiveDataAddr(addr string) {
+	cc.closeDataListener()
 	cc.dataConn.addr = addr
 	cc.dataConn.mode = ftp_cmd.ACTIVE
-	return cc.send(200, "PORT command successful.")
+	cc.mode = ftp_cmd.ACTIVE
+}
+
+// isDataAddrAllowed reports whether the server may open a data connection to addr. To prevent bounce
+// attacks only the client itself is allowed as target, unless the user is allowed to do FXP transfers.
+func (cc *ClientConnection) isDataAddrAllowed(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1024 {
+		return false
+	}
+	if cc.fxpUsers[cc.user] {
+		return true
+	}
+	peer, _, err := net.SplitHostPort(cc.remoteAddr())
+	if err != nil {
+		// The control connection is not a network connection, so there is no peer to compare with.
+		return true
+	}
+	return net.ParseIP(host).Equal(net.ParseIP(peer))
 }
 
 func (cc *ClientConnection) handleRetrCMD(cmd *ftp_cmd.Cmd) error {
@@ -250,25 +801,26 @@ func (cc *ClientConnection) handleRetrCMD(cmd *ftp_cmd.Cmd) error {
 	if err != nil {
 		return cc.send(550, "File not found.")
 	}
-	wait := make(chan struct{})
-	cc.connectToDataConnection(func(ch chan dataPackage) {
-		wait <- struct{}{}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			close(ch)
-			log.Fatal(err)
-		}
-		ch <- dataPackage{action: 'w', payload: data}
-		wait <- struct{}{}
-	})
-	<-wait
-	err = cc.send(150, "Opening ASCII mode data connection.")
+	if err := cc.hooks.BeforeDownload(cc.Session(), path); err != nil {
+		return cc.sendVeto(err)
+	}
+	file, err := os.Open(path)
 	if err != nil {
+		return cc.sendError(&ftp_error.FileUnavailableError{File: path, Err: err})
+	}
+	defer file.Close()
+	defer cc.locks.Read(path)()
+	if info, err := file.Stat(); err == nil {
+		cc.status.setSize(info.Size())
+	}
+	err = cc.transfer("Opening ASCII mode data connection.", func(t *dataTransfer) error {
+		_, err := io.Copy(t, file)
 		return err
+	})
+	if err != nil {
+		return cc.sendError(err)
 	}
-	<-wait
 	return cc.send(226, "Transfer complete.")
-
 }
 
 func (cc *ClientConnection) openDataListener() (chan dataPackage, net.Listener, string, error) {
@@ -278,47 +830,117 @@ func (cc *ClientConnection) openDataListener() (chan dataPackage, net.Listener,
 	}
 	ch := make(chan dataPackage)
 	go func() {
-		conn, err := listener.Accept()
+		conn, err := cc.acceptDataConnection(listener)
 		if err != nil {
-			close(ch)
+			// Fail all requests until the transfer gives up and closes the channel.
+			for p := range ch {
+				p.reply <- dataResult{err: err}
+			}
 			return
 		}
-		defer conn.Close()
-		for p := range ch {
-			cc.handleDataPackage(conn, p)
-		}
+		cc.serveDataConnection(conn, ch)
 	}()
 	tmp := strings.Split(listener.Addr().String(), ":")
 	return ch, listener, tmp[len(tmp)-1], nil
 }
 
+// acceptDataConnection accepts the first data connection that passes verification and closes the listener.
+// Connections from other hosts than the client are rejected so that a port scanner can't hijack transfers.
+func (cc *ClientConnection) acceptDataConnection(listener net.Listener) (net.Conn, error) {
+	// The listener is closed with the session, so that a transfer waiting for the client is aborted.
+	cc.status.setDataConn(listener)
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := cc.verifyDataConnection(conn); err != nil {
+			log.Println(err)
+			conn.Close()
+			continue
+		}
+		cc.status.setDataConn(conn)
+		return conn, nil
+	}
+}
+
+func (cc *ClientConnection) verifyDataConnection(conn net.Conn) error {
+	if !cc.verifyPassiveIP || cc.fxpUsers[cc.user] {
+		return nil
+	}
+	peer, _, err := net.SplitHostPort(cc.remoteAddr())
+	if err != nil {
+		// The control connection is not a network connection, so there is no peer to compare with.
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || !net.ParseIP(host).Equal(net.ParseIP(peer)) {
+		return fmt.Errorf("Rejected data connection from %s, control connection is from %s", conn.RemoteAddr(), peer)
+	}
+	return nil
+}
+
+// closeDataListener closes the passive listener and its channel if they haven't been used by a transfer.
+func (cc *ClientConnection) closeDataListener() {
+	if cc.dataConn.ln != nil {
+		cc.dataConn.ln.Close()
+		cc.dataConn.ln = nil
+	}
+	if cc.dataConn.ch != nil {
+		close(cc.dataConn.ch)
+		cc.dataConn.ch = nil
+	}
+}
+
 func (cc *ClientConnection) openDataConnection(addr string) (chan dataPackage, error) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	ch := make(chan dataPackage)
-	go func() {
-		defer conn.Close()
-		for p := range ch {
-			cc.handleDataPackage(conn, p)
-		}
-	}()
+	go cc.serveDataConnection(conn, ch)
 	return ch, nil
 }
 
-func (cc *ClientConnection) needAuth(cmd *ftp_cmd.Cmd) bool {
-	switch cmd.Type {
-	case ftp_cmd.USER, ftp_cmd.PASS, ftp_cmd.QUIT:
-		return false
+// serveDataConnection handles the packages of a transfer. The stream is set up with the transfer mode and
+// protection of the first package, which the control goroutine copies at the transfer command.
+func (cc *ClientConnection) serveDataConnection(conn net.Conn, ch chan dataPackage) {
+	var stream *dataStream
+	for p := range ch {
+		if stream == nil {
+			if p.tlsConfig != nil {
+				conn = tls.Server(conn, p.tlsConfig)
+			}
+			stream = newDataStream(conn, p.compress, p.level)
+			cc.status.setDataConn(conn)
+			defer cc.status.setDataConn(nil)
+		}
+		cc.handleDataPackage(stream, p)
 	}
-	return true
+	if stream == nil {
+		conn.Close()
+		return
+	}
+	stream.Close()
+}
+
+func (cc *ClientConnection) needAuth(cmd *ftp_cmd.Cmd) bool {
+	spec, _ := ftp_cmd.Lookup(cmd.Type)
+	return !spec.NoAuth
 }
 
 func (cc *ClientConnection) getDataChannel() (chan dataPackage, error) {
 	switch cc.mode {
 	case ftp_cmd.PASSIVE:
-		return cc.dataConn.ch, nil
+		// A passive data connection can only be used for one transfer.
+		ch := cc.dataConn.ch
+		if ch == nil {
+			return nil, errors.New("No passive data connection, use PASV or EPSV first")
+		}
+		cc.dataConn.ch = nil
+		cc.dataConn.ln = nil
+		return ch, nil
 	case ftp_cmd.ACTIVE:
 		return cc.openDataConnection(cc.dataConn.addr)
 	default:
@@ -331,48 +953,133 @@ func (cc *ClientConnection) notImplementedError(cmd *ftp_cmd.Cmd) error {
 	if err != nil {
 		return err
 	}
-	return &ftp_error.NotImplementedError{string(cmd.Type)}
+	return &ftp_error.NotImplementedError{Cmd: string(cmd.Type)}
 }
 
 func (cc *ClientConnection) send(status int, text string) error {
+	text = ftp_charset.Encode(text, cc.legacyCharset())
 	_, err := fmt.Fprintf(cc.ctrlConn, "%d %s\n", status, text)
 	return err
 }
 
+func (cc *ClientConnection) sendMultiline(status int, first string, lines []string, last string) error {
+	text := fmt.Sprintf("%d-%s\n", status, first)
+	for _, line := range lines {
+		text += " " + line + "\n"
+	}
+	text += fmt.Sprintf("%d %s\n", status, last)
+	_, err := io.WriteString(cc.ctrlConn, ftp_charset.Encode(text, cc.legacyCharset()))
+	return err
+}
+
+// sendError replies with the reply of err if it is a ftp_error.ReplyError and with 451 otherwise.
+func (cc *ClientConnection) sendError(err error) error {
+	log.Println(err)
+	if replyErr, ok := err.(ftp_error.ReplyError); ok {
+		return cc.send(replyErr.Reply())
+	}
+	return cc.send(451, "Requested action aborted: local error in processing.")
+}
+
+// sendVeto replies to an operation vetoed by a hook.
+func (cc *ClientConnection) sendVeto(err error) error {
+	if _, ok := err.(ftp_error.ReplyError); ok {
+		return cc.sendError(err)
+	}
+	return cc.send(550, err.Error())
+}
+
+func (cc *ClientConnection) remoteAddr() string {
+	if conn, ok := cc.ctrlConn.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// checkUpload checks the name of a file the client wants to create against the upload rules and returns
+// its maximum size.
+func (cc *ClientConnection) checkUpload(fileName string) (int64, error) {
+	virtual, _, err := cc.dirPath.resolve(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return cc.uploadFilter.Check(cc.user, virtual)
+}
+
+func (cc *ClientConnection) getFilePath(fileName string) (string, error) {
+	_, filePath, err := cc.dirPath.resolve(fileName)
+	return filePath, err
+}
+
 func (cc *ClientConnection) getFilePathIfExist(fileName string) (string, error) {
-	var newPath string
-	if filepath.IsAbs(fileName) {
-		newPath = fileName
-	} else {
-		newPath = filepath.Join(cc.dirPath.current, fileName)
+	filePath, err := cc.getFilePath(fileName)
+	if err != nil {
+		return "", err
 	}
-	filePath := filepath.Join(cc.dirPath.root, newPath)
 	if !fileExist(filePath) {
-		return "", &ftp_error.FileNotFoundError{filePath}
+		return "", &ftp_error.FileNotFoundError{File: filePath}
 	}
 	return filePath, nil
 }
 
-func (cc *ClientConnection) connectToDataConnection(action func(ch chan dataPackage)) {
-	go func() {
-		ch, err := cc.getDataChannel()
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer close(ch)
-		action(ch)
-	}()
+// transfer opens the data connection, sends the preliminary reply and runs action. The data connection is
+// closed when action returns. The final reply is left to the caller.
+func (cc *ClientConnection) transfer(msg string, action func(t *dataTransfer) error) error {
+	ch, err := cc.getDataChannel()
+	if err != nil {
+		return &ftp_error.DataConnectionError{Err: err}
+	}
+	defer close(ch)
+	if err := cc.send(150, msg); err != nil {
+		return err
+	}
+	t := &dataTransfer{ch: ch, reply: make(chan dataResult), status: &cc.status, compress: cc.compress,
+		level: cc.compressLevel, tlsConfig: cc.dataTLSConfig()}
+	if err := action(t); err != nil {
+		return err
+	}
+	return t.Close()
 }
 
-func (cc *ClientConnection) handleDataPackage(conn net.Conn, p dataPackage) {
+func (cc *ClientConnection) handleDataPackage(stream *dataStream, p dataPackage) {
+	var result dataResult
 	switch p.action {
 	case 'r':
-		n, err := conn.Read(p.payload)
-		if err != nil {
-			log.Fatal(err)
+		result.n, result.err = stream.Read(p.payload)
+		if result.err == io.EOF {
+			result.err = nil
 		}
-		p.reply <- n
 	case 'w':
-		conn.Write(p.payload)
+		result.n, result.err = stream.Write(p.payload)
+	case 'c':
+		result.err = stream.Close()
+	}
+	p.reply <- result
+}
+
+func quotaLimit(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// parseHashRange splits "name [start end]" into its components, end is -1 if no range is given.
+func parseHashRange(arg string) (string, int64, int64) {
+	fields := strings.Fields(arg)
+	if len(fields) < 3 {
+		return arg, 0, -1
+	}
+	start, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil || start < 0 {
+		return arg, 0, -1
+	}
+	end, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil || end < start {
+		return arg, 0, -1
 	}
+	name := strings.TrimRight(arg, " ")
+	name = strings.TrimRight(name[:len(name)-len(fields[len(fields)-1])], " ")
+	name = strings.TrimSpace(name[:len(name)-len(fields[len(fields)-2])])
+	return name, start, end
 }
@@ -2,6 +2,10 @@ package client_connection_test
 
 import (
 	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -10,9 +14,17 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
 
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_filter"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hooks"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_lock"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_quota"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server/client_connection"
 	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
 )
@@ -241,7 +253,7 @@ func TestDele(t *testing.T) {
 	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
 		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
 	}
-	expected := []byte("200 DELE command successful.\n")
+	expected := []byte("250 DELE command successful.\n")
 	if !bytes.Equal(buf.Bytes(), expected) {
 		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
 			strings.TrimSuffix(string(expected), "\n"))
@@ -275,7 +287,7 @@ func TestDele(t *testing.T) {
 	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
 		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
 	}
-	expected = []byte("200 DELE command successful.\n")
+	expected = []byte("250 DELE command successful.\n")
 	if !bytes.Equal(buf.Bytes(), expected) {
 		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
 			strings.TrimSuffix(string(expected), "\n"))
@@ -306,7 +318,7 @@ func TestDele(t *testing.T) {
 	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
 		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
 	}
-	expected = []byte("200 DELE command successful.\n")
+	expected = []byte("250 DELE command successful.\n")
 	if !bytes.Equal(buf.Bytes(), expected) {
 		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
 			strings.TrimSuffix(string(expected), "\n"))
@@ -333,10 +345,11 @@ func TestStorPASV(t *testing.T) {
 	filedata := []byte("Hello, world!")
 
 	dialDataConn(addr, &wg, func(conn net.Conn) {
-		_, err = conn.Write(filedata)
+		_, err := conn.Write(filedata)
 		if err != nil {
 			log.Fatal(err)
 		}
+		conn.Close()
 	})
 
 	err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: filename})
@@ -372,7 +385,7 @@ func TestStorPASV(t *testing.T) {
 	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
 		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
 	}
-	expected = []byte("200 DELE command successful.\n")
+	expected = []byte("250 DELE command successful.\n")
 	if !bytes.Equal(buf.Bytes(), expected) {
 		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
 			strings.TrimSuffix(string(expected), "\n"))
@@ -383,6 +396,152 @@ func TestStorPASV(t *testing.T) {
 	buf.Reset()
 }
 
+func TestStouPASV(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+
+	cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+	addr, err := ftp_ip.Decode(string(buf.Bytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf.Reset()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	filedata := []byte("Hello, world!")
+	dialDataConn(addr, &wg, func(conn net.Conn) {
+		if _, err := conn.Write(filedata); err != nil {
+			log.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOU})
+	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	wg.Wait()
+	lines := strings.Split(string(buf.Bytes()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "150 FILE: ") || lines[1] != "226 Transfer complete." {
+		t.Fatalf("Error actual = %s, and Expected = %s.", string(buf.Bytes()), "150 FILE: <name>, 226 Transfer complete.")
+	}
+	filename := root + "/" + strings.TrimPrefix(lines[0], "150 FILE: ")
+	defer os.Remove(filename)
+	actualFileData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actualFileData, filedata) {
+		t.Errorf("Error actual = %s, and Expected = %s.", string(actualFileData), string(filedata))
+	}
+}
+
+func TestStorAborted(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	quota := ftp_quota.NewManager()
+	quota.SetQuota("user", ftp_quota.Quota{MaxBytes: 1 << 20})
+	cc.SetQuotaManager(quota)
+	authenticate(cc, buf)
+
+	cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+	addr, err := ftp_ip.Decode(string(buf.Bytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf.Reset()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	dialDataConn(addr, &wg, func(conn net.Conn) {
+		// The server closes the connection when the quota is exceeded.
+		conn.Write(make([]byte, 2<<20))
+		conn.Close()
+	})
+
+	filename := "aborted.txt"
+	err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: filename})
+	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	wg.Wait()
+	expected := []byte("150 Opening ASCII mode data connection for file.\n552 Exceeded storage allocation.\n")
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+			strings.TrimSuffix(string(expected), "\n"))
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), filename) {
+			t.Errorf("Error actual = %s, and Expected = %s.", file.Name(), "no file")
+		}
+	}
+}
+
+func TestUploadFilter(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	cc.SetUploadFilter(ftp_filter.New(
+		ftp_filter.Rule{Dir: "/1", AllowExt: []string{"csv"}, DenyHidden: true, MaxSize: 1024},
+		ftp_filter.Rule{Deny: []string{"*.exe"}}))
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "setup.EXE"}, []byte("553 Requested action not taken. File name not allowed.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "1/data.txt"}, []byte("553 Requested action not taken. File name not allowed.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "1/.data.csv"}, []byte("553 Requested action not taken. File name not allowed.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNFR, Arg: "test_file"}, []byte("350 File exists, ready for destination name.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNTO, Arg: "1/test_file"}, []byte("553 Requested action not taken. File name not allowed.\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+
+	cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+	addr, err := ftp_ip.Decode(string(buf.Bytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf.Reset()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	dialDataConn(addr, &wg, func(conn net.Conn) {
+		// The server closes the connection when the maximum size is exceeded.
+		conn.Write(make([]byte, 1<<20))
+		conn.Close()
+	})
+	err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "1/large.csv"})
+	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	wg.Wait()
+	expected := []byte("150 Opening ASCII mode data connection for file.\n552 Exceeded the maximum file size of 1024 bytes.\n")
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+			strings.TrimSuffix(string(expected), "\n"))
+	}
+	if _, err := os.Stat(root + "/1/large.csv"); !os.IsNotExist(err) {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "no file")
+	}
+}
+
 func TestStorACTIVE(t *testing.T) {
 	cc, buf, authCh := initCC()
 	defer close(authCh)
@@ -445,7 +604,7 @@ func TestStorACTIVE(t *testing.T) {
 	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
 		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
 	}
-	expected = []byte("200 DELE command successful.\n")
+	expected = []byte("250 DELE command successful.\n")
 	if !bytes.Equal(buf.Bytes(), expected) {
 		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
 			strings.TrimSuffix(string(expected), "\n"))
@@ -541,6 +700,894 @@ func TestRetrACTIVE(t *testing.T) {
 	wg.Wait()
 }
 
+type recordingHooks struct {
+	ftp_hooks.NopHooks
+	events []string
+}
+
+func (h *recordingHooks) OnLogin(s ftp_hooks.Session, success bool) {
+	h.events = append(h.events, "login "+s.User)
+}
+
+func (h *recordingHooks) BeforeDownload(s ftp_hooks.Session, path string) error {
+	return &ftp_hooks.Veto{Code: 553, Message: "Downloads disabled."}
+}
+
+func (h *recordingHooks) OnRename(s ftp_hooks.Session, from, to string) {
+	h.events = append(h.events, "rename "+from+" "+to)
+}
+
+func TestHooks(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	hooks := &recordingHooks{}
+	cc.SetHooks(hooks)
+	authenticate(cc, buf)
+
+	if err := ioutil.WriteFile(root+"/t2", []byte("Hello, World!"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(root + "/t3")
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "test_file"}, []byte("553 Downloads disabled.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNTO, Arg: "t3"}, []byte("503 Bad sequence of commands.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNFR, Arg: "t2"}, []byte("350 File exists, ready for destination name.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNTO, Arg: "t3"}, []byte("250 Rename successful.\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+
+	expected := []string{"login user", "rename " + root + "/t2 " + root + "/t3"}
+	if strings.Join(hooks.events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Error actual = %v, and Expected = %v.", hooks.events, expected)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	initCC()
+	authCh := make(chan client_connection.AuthPkg)
+	defer close(authCh)
+	go func() {
+		for auth := range authCh {
+			auth.ReplyCh <- client_connection.AuthReply{OK: true, Home: "quota_home"}
+		}
+	}()
+	home := root + "/quota_home"
+	os.RemoveAll(home)
+	if err := os.Mkdir(home, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for name, content := range map[string]string{"a": "Hello", "b": "abc"} {
+		if err := ioutil.WriteFile(home+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mountRoot, err := ioutil.TempDir("", "ftp_mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountRoot)
+	if err := ioutil.WriteFile(mountRoot+"/m", []byte("Hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	cc := client_connection.New(buf, authCh, root, "127.0.0.1")
+	cc.SetMounts([]ftp_path.Mount{{Path: "/uploads", Root: mountRoot}})
+	quota := ftp_quota.NewManager()
+	quota.SetQuota("user", ftp_quota.Quota{MaxBytes: 12, MaxFiles: 5})
+	cc.SetQuotaManager(quota)
+	authenticate(cc, buf)
+
+	// stor uploads data, the server closes the data connection if the quota is exceeded.
+	stor := func(name string, data []byte) {
+		cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+		addr, err := ftp_ip.Decode(string(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		dialDataConn(addr, &wg, func(conn net.Conn) {
+			conn.Write(data)
+			conn.Close()
+		})
+		if err := cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: name}); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+		wg.Wait()
+	}
+	site := func(arg string) {
+		if err := cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.SITE, Arg: arg}); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+	}
+	dele := func(arg string) {
+		if err := cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.DELE, Arg: arg}); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+	}
+	rename := func(from, to string) {
+		for _, cmd := range []ftp_cmd.Cmd{{Type: ftp_cmd.RNFR, Arg: from}, {Type: ftp_cmd.RNTO, Arg: to}} {
+			if err := cc.Reply(&cmd); err != nil {
+				t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+			}
+		}
+	}
+
+	var tests = []struct {
+		action   func()
+		expected string
+	}{
+		// Only the home directory counts, not the rest of the root.
+		{func() { site("QUOTA") }, "200 Quota for user: 8/12 bytes, 2/5 files.\n"},
+		{func() { stor("c", []byte("1234")) }, "150 Opening ASCII mode data connection for file.\n226 Transfer complete.\n"},
+		{func() { site("QUOTA") }, "200 Quota for user: 12/12 bytes, 3/5 files.\n"},
+		// The upload is allowed to start, and fails with the first byte that exceeds the quota.
+		{func() { stor("d", make([]byte, 10)) }, "150 Opening ASCII mode data connection for file.\n552 Exceeded storage allocation.\n"},
+		{func() { site("QUOTA") }, "200 Quota for user: 12/12 bytes, 3/5 files.\n"},
+		// Mounts are outside the home directory and don't count.
+		{func() { stor("/uploads/e", make([]byte, 10)) }, "150 Opening ASCII mode data connection for file.\n226 Transfer complete.\n"},
+		{func() { dele("/uploads/m") }, "250 DELE command successful.\n"},
+		{func() { site("QUOTA") }, "200 Quota for user: 12/12 bytes, 3/5 files.\n"},
+		{func() { dele("c") }, "250 DELE command successful.\n"},
+		{func() { site("QUOTA") }, "200 Quota for user: 8/12 bytes, 2/5 files.\n"},
+		{func() { rename("a", "/uploads/a") }, "350 File exists, ready for destination name.\n250 Rename successful.\n"},
+		{func() { site("QUOTA") }, "200 Quota for user: 3/12 bytes, 1/5 files.\n"},
+		{func() { site("UNKNOWN") }, "504 'SITE UNKNOWN': command not implemented.\n"},
+	}
+	for _, test := range tests {
+		test.action()
+		if buf.String() != test.expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", buf.String(), test.expected)
+		}
+		buf.Reset()
+	}
+	if _, err := os.Stat(home + "/d"); !os.IsNotExist(err) {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "no file")
+	}
+}
+
+func TestHash(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+	if err := ioutil.WriteFile("/tmp/test_dir/empty_file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("/tmp/test_dir/empty_file")
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.FEAT}, []byte("211-Features:\n HASH SHA-256*;SHA-1;MD5;CRC32\n LANG EN*\n MODE Z\n UTF8\n211 End\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.HASH, Arg: "test_file"},
+			[]byte("213 SHA-256 0-12 dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f test_file\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.OPTS, Arg: "HASH"}, []byte("200 SHA-256\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.OPTS, Arg: "HASH SHA-512"}, []byte("501 Unknown algorithm, current selection not changed.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.OPTS, Arg: "HASH md5"}, []byte("200 MD5\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.HASH, Arg: "/test_file"}, []byte("213 MD5 0-12 65a8e27d8879283831b664bd8b7f0ad4 /test_file\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.HASH, Arg: "empty_file"}, []byte("213 MD5 0-0 d41d8cd98f00b204e9800998ecf8427e empty_file\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.HASH, Arg: "missing"}, []byte("550 File not found.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.HASH, Arg: "1"}, []byte("553 Not a plain file.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XMD5, Arg: "test_file"}, []byte("250 65a8e27d8879283831b664bd8b7f0ad4\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XMD5, Arg: "test_file 0 4"}, []byte("250 8b1a9953c4611296a827abf8c47804d7\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XSHA1, Arg: "test_file"}, []byte("250 0a0a9f2a6772942557ab5355d76af442f8f65e01\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XCRC, Arg: "test_file"}, []byte("250 ec4ac3d0\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+}
+
+func TestRetrModeZ(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.MODE_CMD, Arg: "B"}, []byte("504 Command not implemented for that parameter.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.OPTS, Arg: "MODE Z LEVEL 10"}, []byte("501 Invalid compression level.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.OPTS, Arg: "MODE Z LEVEL 9"}, []byte("200 MODE Z LEVEL set to 9.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.MODE_CMD, Arg: "Z"}, []byte("200 Mode set to Z.\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+
+	cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+	addr, err := ftp_ip.Decode(string(buf.Bytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf.Reset()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	dialDataConn(addr, &wg, func(conn net.Conn) {
+		zr, err := zlib.NewReader(conn)
+		if err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+			return
+		}
+		result, err := ioutil.ReadAll(zr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		exp := []byte("Hello, World!")
+		if !bytes.Equal(result, exp) {
+			t.Errorf("Error actual = %s, and Expected = %s.", string(result), string(exp))
+		}
+		conn.Close()
+	})
+
+	expected := []byte("150 Opening ASCII mode data connection.\n226 Transfer complete.\n")
+	err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "test_file"})
+	if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+			strings.TrimSuffix(string(expected), "\n"))
+	}
+	wg.Wait()
+}
+
+func TestStorModeZ(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+	defer os.Remove(root + "/mode_z_file")
+
+	compressed := func(data []byte) []byte {
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		zw.Write(data)
+		zw.Close()
+		return b.Bytes()
+	}
+	var tests = []struct {
+		// mode is sent after PASV, it applies to the transfer all the same.
+		mode     string
+		upload   []byte
+		expected string
+	}{
+		{"Z", compressed([]byte("Hello, World!")), "Hello, World!"},
+		{"S", []byte("Hello, Zlib!"), "Hello, Zlib!"},
+	}
+	for _, test := range tests {
+		cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+		addr, err := ftp_ip.Decode(string(buf.Bytes()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.MODE_CMD, Arg: test.mode})
+		buf.Reset()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		dialDataConn(addr, &wg, func(conn net.Conn) {
+			conn.Write(test.upload)
+			conn.Close()
+		})
+		err = cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "mode_z_file"})
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		wg.Wait()
+		expected := "150 Opening ASCII mode data connection for file.\n226 Transfer complete.\n"
+		if buf.String() != expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", buf.String(), expected)
+		}
+		buf.Reset()
+		content, err := ioutil.ReadFile(root + "/mode_z_file")
+		if err != nil || string(content) != test.expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", content, test.expected)
+		}
+	}
+}
+
+// peerConn is a control connection with a fixed remote address.
+type peerConn struct {
+	*bytes.Buffer
+	remote string
+}
+
+func (c peerConn) Close() error                       { return nil }
+func (c peerConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21} }
+func (c peerConn) RemoteAddr() net.Addr               { addr, _ := net.ResolveTCPAddr("tcp", c.remote); return addr }
+func (c peerConn) SetDeadline(t time.Time) error      { return nil }
+func (c peerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c peerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestPortPolicy(t *testing.T) {
+	_, _, authCh := initCC()
+	defer close(authCh)
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	cc := client_connection.New(peerConn{buf, "10.0.0.1:5000"}, authCh, root, "127.0.0.1")
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		fxp      bool
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: "127,0,0,1,39,17"}, false, []byte("500 Illegal PORT command.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: "10,0,0,1,0,21"}, false, []byte("500 Illegal PORT command.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: "10,0,0,1,39,17"}, false, []byte("200 PORT command successful.\n")},
+		// Ports above 65535 are rejected.
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: "10,0,0,1,256,17"}, true, []byte("501 Syntax error in parameters or arguments.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.EPRT, Arg: "|1|127.0.0.1|10001|"}, false, []byte("500 Illegal EPRT command.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.EPRT, Arg: "|1|10.0.0.1|10001|"}, false, []byte("200 EPRT command successful.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.EPRT, Arg: "|3|10.0.0.1|10001|"}, false, []byte("522 Network protocol not supported, use (1,2)\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: "127,0,0,1,39,17"}, true, []byte("200 PORT command successful.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.EPRT, Arg: "|1|127.0.0.1|10001|"}, true, []byte("200 EPRT command successful.\n")},
+	}
+	for _, test := range tests {
+		cc.SetFXPUsers(map[string]bool{"user": test.fxp})
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+}
+
+func TestPassiveSourceVerification(t *testing.T) {
+	_, _, authCh := initCC()
+	defer close(authCh)
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	cc := client_connection.New(peerConn{buf, "10.0.0.1:5000"}, authCh, root, "127.0.0.1")
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		verify   bool
+		accepted bool
+	}{
+		{true, false},
+		{false, true},
+	}
+	for _, test := range tests {
+		cc.SetVerifyPassiveIP(test.verify)
+		cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+		addr, err := ftp_ip.Decode(string(buf.Bytes()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		buf.Reset()
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// A rejected connection is closed by the server, an accepted one is kept open waiting for a transfer.
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		timeout, ok := err.(net.Error)
+		accepted := ok && timeout.Timeout()
+		if accepted != test.accepted {
+			t.Errorf("Error actual = %v, and Expected = %v.", accepted, test.accepted)
+		}
+		conn.Close()
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "test_file"}, []byte("425 Can't open data connection.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PORT, Arg: fmt.Sprintf("127,0,0,1,%d,%d", closedPort/256, closedPort%256)},
+			[]byte("200 PORT command successful.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.LIST, Arg: ""}, []byte("425 Can't open data connection.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "test_file_error"}, []byte("425 Can't open data connection.\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+	if _, err := os.Stat(root + "/test_file_error"); !os.IsNotExist(err) {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "file not exist")
+	}
+}
+
+func TestCloseWaitingTransfer(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	authenticate(cc, buf)
+	cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.PASV, Arg: ""})
+	buf.Reset()
+
+	// The client never opens the data connection, closing the session aborts the transfer.
+	done := make(chan error)
+	go func() {
+		done <- cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.RETR, Arg: "test_file"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cc.Close()
+	select {
+	case err := <-done:
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error actual = blocked transfer, and Expected = aborted transfer.")
+	}
+	expected := "150 Opening ASCII mode data connection.\n426 Connection closed; transfer aborted.\n"
+	if buf.String() != expected {
+		t.Errorf("Error actual = %q, and Expected = %q.", buf.String(), expected)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	maintenance := true
+	cc.SetMaintenance(func() bool { return maintenance })
+
+	var tests = []struct {
+		input       ftp_cmd.Cmd
+		maintenance bool
+		expected    []byte
+		status      string
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.USER, Arg: "user"}, true, []byte("421 Service not available, server is in maintenance mode.\n"), ""},
+		{ftp_cmd.Cmd{Type: ftp_cmd.USER, Arg: "user"}, false, []byte("331 Password required for user.\n"), ""},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PASS, Arg: "pass"}, false, []byte("230 User logged in.\n"), "user"},
+		{ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: "1"}, true, []byte("250 CWD command successful.\n"), "user"},
+	}
+	for _, test := range tests {
+		maintenance = test.maintenance
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		if status := cc.Status(); status.User != test.status {
+			t.Errorf("Error actual = %v, and Expected = %v.", status.User, test.status)
+		}
+		buf.Reset()
+	}
+	if status := cc.Status(); status.Cwd != "/1" || status.Transfer != "" || status.Size != -1 {
+		t.Errorf("Error actual = %+v, and Expected = %s.", status, "Cwd /1 and no transfer")
+	}
+}
+
+func TestMounts(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	mountRoot, err := ioutil.TempDir("", "ftp_mount")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(mountRoot)
+	if err := ioutil.WriteFile(mountRoot+"/release", []byte("v1"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	cc.SetMounts([]ftp_path.Mount{{Path: "/releases", Root: mountRoot, ReadOnly: true}})
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: "/releases"}, []byte("250 CWD command successful.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XMD5, Arg: "release"}, []byte("250 6654c734ccab8f440ff0825eb443dc7f\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "new_release"}, []byte("550 Permission denied.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.DELE, Arg: "release"}, []byte("550 Permission denied.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNFR, Arg: "release"}, []byte("550 Permission denied.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: ".."}, []byte("250 CWD command successful.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.DELE, Arg: "releases"}, []byte("550 Permission denied.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.XMD5, Arg: "releases/release"}, []byte("250 6654c734ccab8f440ff0825eb443dc7f\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+	if _, err := os.Stat(mountRoot + "/release"); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	locks := ftp_lock.NewManager(ftp_lock.Reject, 0)
+	cc.SetLockManager(locks)
+	authenticate(cc, buf)
+
+	other := locks.NewLocker()
+	defer other.ReleaseAll()
+	other.Read(root + "/test_file")
+	if _, err := other.Write(root + "/busy_file"); err != nil {
+		log.Fatal(err)
+	}
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected []byte
+	}{
+		{ftp_cmd.Cmd{Type: ftp_cmd.STOR, Arg: "busy_file"}, []byte("450 File busy.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.DELE, Arg: "test_file"}, []byte("450 File busy.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNFR, Arg: "test_file"}, []byte("350 File exists, ready for destination name.\n")},
+		{ftp_cmd.Cmd{Type: ftp_cmd.RNTO, Arg: "renamed_file"}, []byte("450 File busy.\n")},
+	}
+	for _, test := range tests {
+		err := cc.Reply(&test.input)
+		if ok, want, have := test_utils.VerifyError(err, nil); !ok {
+			t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("Error actual = %s, and Expected = %s.", strings.TrimSuffix(string(buf.Bytes()), "\n"),
+				strings.TrimSuffix(string(test.expected), "\n"))
+		}
+		buf.Reset()
+	}
+	if _, err := os.Stat(root + "/test_file"); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	ftp_cmd.Register("XWHOAMI", ftp_cmd.Spec{})
+	ftp_cmd.Register("XPUBLIC", ftp_cmd.Spec{Arg: ftp_cmd.OptionalArg, NoAuth: true})
+	cc.SetCommands(map[ftp_cmd.CmdType]client_connection.Handler{
+		"XWHOAMI": func(ctx *client_connection.Context, cmd *ftp_cmd.Cmd) error {
+			return ctx.Reply(200, ctx.Session().User+" "+ctx.Cwd())
+		},
+		"XPUBLIC": func(ctx *client_connection.Context, cmd *ftp_cmd.Cmd) error {
+			path, err := ctx.Resolve(cmd.Arg)
+			if err != nil {
+				return ctx.ReplyError(err)
+			}
+			return ctx.Reply(200, strings.TrimPrefix(path, root))
+		},
+	})
+
+	var tests = []struct {
+		input    ftp_cmd.Cmd
+		expected string
+	}{
+		{ftp_cmd.Cmd{Type: "XWHOAMI"}, "530 Please login with USER and PASS.\n"},
+		{ftp_cmd.Cmd{Type: "XPUBLIC", Arg: "1"}, "200 /1\n"},
+		{ftp_cmd.Cmd{Type: "XPUBLIC", Arg: "../../2"}, "200 /2\n"},
+		{ftp_cmd.Cmd{Type: ftp_cmd.USER, Arg: "user"}, "331 Password required for user.\n"},
+		{ftp_cmd.Cmd{Type: ftp_cmd.PASS, Arg: "pass"}, "230 User logged in.\n"},
+		{ftp_cmd.Cmd{Type: ftp_cmd.CWD, Arg: "2"}, "250 CWD command successful.\n"},
+		{ftp_cmd.Cmd{Type: "XWHOAMI"}, "200 user /2\n"},
+		{ftp_cmd.Cmd{Type: "XUNKNOWN"}, "500 'XUNKNOWN': command not understood.\n"},
+	}
+	for _, test := range tests {
+		if err := cc.Reply(&test.input); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", buf.String(), test.expected)
+		}
+		buf.Reset()
+	}
+}
+
+func TestSite(t *testing.T) {
+	cc, buf, authCh := initCC()
+	defer close(authCh)
+	defer os.Chmod(root+"/test_file", 0644)
+	cc.SetSiteCommands(map[string]client_connection.Handler{
+		"REINDEX": func(ctx *client_connection.Context, cmd *ftp_cmd.Cmd) error {
+			return ctx.Reply(200, "Reindexed "+cmd.Arg+".")
+		},
+	})
+	cc.SetSessions(func() []client_connection.Status {
+		return []client_connection.Status{{User: "user", RemoteAddr: "127.0.0.1:1234", Cwd: "/1", Idle: 90 * time.Second}}
+	})
+	mountRoot, err := ioutil.TempDir("", "ftp_mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountRoot)
+	if err := ioutil.WriteFile(mountRoot+"/release", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountInfo, err := os.Stat(mountRoot + "/release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.SetMounts([]ftp_path.Mount{{Path: "/releases", Root: mountRoot, ReadOnly: true}})
+	authenticate(cc, buf)
+
+	var tests = []struct {
+		arg      string
+		admin    bool
+		expected string
+	}{
+		{"CHMOD 600 test_file", false, "200 SITE CHMOD command successful.\n"},
+		{"chmod 4755 test_file", false, "501 Invalid mode 4755.\n"},
+		{"CHMOD 755", false, "501 Syntax error in parameters or arguments.\n"},
+		{"CHMOD 755 missing_file", false, "550 File not found.\n"},
+		{"UTIME 20200102030405 test_file", false, "200 SITE UTIME command successful.\n"},
+		{"UTIME test_file 20210102030405 20210102030405 20210102030405 UTC", false, "200 SITE UTIME command successful.\n"},
+		{"UTIME yesterday test_file", false, "501 Syntax error in parameters or arguments.\n"},
+		// Files in read-only mounts can't be changed.
+		{"CHMOD 600 /releases/release", false, "550 Permission denied.\n"},
+		{"UTIME 20200102030405 /releases/release", false, "550 Permission denied.\n"},
+		{"UTIME /releases/release 20210102030405 20210102030405 20210102030405 UTC", false, "550 Permission denied.\n"},
+		{"WHO", false, "550 Permission denied.\n"},
+		{"WHO", true, "200-Sessions:\n user             127.0.0.1:1234           idle 1m30s    /1\n200 1 sessions.\n"},
+		{"HELP", false, "214-The following SITE commands are recognized:\n CHMOD\n HELP\n QUOTA\n REINDEX\n UTIME\n WHO\n214 Help OK.\n"},
+		{"REINDEX all files", false, "200 Reindexed all files.\n"},
+	}
+	for _, test := range tests {
+		cc.SetAdmins(map[string]bool{"user": test.admin})
+		if err := cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.SITE, Arg: test.arg}); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Error actual = %s, and Expected = %s.", buf.String(), test.expected)
+		}
+		buf.Reset()
+	}
+	info, err := os.Stat(root + "/test_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Error actual = %v, and Expected = %v.", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if expected := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC); !info.ModTime().Equal(expected) {
+		t.Errorf("Error actual = %v, and Expected = %v.", info.ModTime(), expected)
+	}
+	info, err = os.Stat(mountRoot + "/release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != mountInfo.Mode() || !info.ModTime().Equal(mountInfo.ModTime()) {
+		t.Errorf("Error actual = %v %v, and Expected = %v %v.", info.Mode(), info.ModTime(), mountInfo.Mode(), mountInfo.ModTime())
+	}
+}
+
+func TestCharset(t *testing.T) {
+	_, _, authCh := initCC()
+	defer close(authCh)
+	if err := os.MkdirAll(root+"/räksmörgås", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	cc, buf := scriptCC("CWD r\xe4ksm\xf6rg\xe5s\r\nPWD\r\nCWD /\r\nCWD ra\u0308ksmo\u0308rga\u030as\r\n"+
+		"OPTS UTF8 ON\r\nCWD r\xe4k\r\nPWD\r\nLANG sv\r\nLANG en-US\r\n", authCh)
+	cc.SetFallbackCharset(charmap.ISO8859_1)
+	authenticate(cc, buf)
+
+	actual := runScript(t, cc, buf)
+	expected := "250 CWD command successful.\n257 \"/r\xe4ksm\xf6rg\xe5s\" is current directory.\n" +
+		"250 CWD command successful.\n250 CWD command successful.\n200 UTF8 set to on.\n" +
+		"501 Invalid UTF-8 in argument.\n257 \"/räksmörgås\" is current directory.\n" +
+		"504 Unsupported language.\n200 Language set to EN.\n"
+	if actual != expected {
+		t.Errorf("Error actual = %q, and Expected = %q.", actual, expected)
+	}
+}
+
+func TestHost(t *testing.T) {
+	initCC()
+	authCh := make(chan client_connection.AuthPkg)
+	defer close(authCh)
+	go func() {
+		for auth := range authCh {
+			ok := auth.Host == "www.example.com" && auth.User == "web" && auth.Password == "pass"
+			auth.ReplyCh <- client_connection.AuthReply{OK: ok}
+		}
+	}()
+	cc, buf := scriptCC("HOST ftp.example.com\r\nHOST WWW.Example.COM.\r\nUSER web\r\nPASS pass\r\n"+
+		"CWD 2\r\nHOST www.example.com\r\n", authCh)
+	cc.SetVirtualHosts(map[string]client_connection.VirtualHost{
+		"www.example.com": {Root: root + "/1", Welcome: "Welcome to\nwww.example.com.\n"},
+	})
+
+	actual := runScript(t, cc, buf)
+	expected := "504 Unknown host ftp.example.com.\n220-Welcome to\n220 www.example.com.\n" +
+		"331 Password required for web.\n230 User logged in.\n550 Invalid path.\n" +
+		"503 Already logged in.\n"
+	if actual != expected {
+		t.Errorf("Error actual = %q, and Expected = %q.", actual, expected)
+	}
+}
+
+func TestProtection(t *testing.T) {
+	initCC()
+	var tests = []struct {
+		tlsConfig *tls.Config
+		script    string
+		expected  string
+	}{
+		{nil, "PBSZ 0\r\nPROT P\r\n",
+			"503 PBSZ requires a TLS protected control connection.\n503 PROT requires a TLS protected control connection.\n"},
+		{&tls.Config{}, "PROT P\r\nPBSZ 1024\r\nPROT S\r\nPROT X\r\nPROT c\r\n",
+			"503 PROT requires PBSZ first.\n200 PBSZ=0\n536 Requested protection level not supported.\n" +
+				"504 Command not implemented for that parameter.\n200 Protection level set to C.\n"},
+	}
+	for _, test := range tests {
+		cc, buf := scriptCC(test.script, nil)
+		cc.SetTLSConfig(test.tlsConfig)
+		if actual := runScript(t, cc, buf); actual != test.expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", actual, test.expected)
+		}
+	}
+}
+
+func TestAccount(t *testing.T) {
+	initCC()
+	authCh := make(chan client_connection.AuthPkg)
+	defer close(authCh)
+	go func() {
+		for auth := range authCh {
+			switch auth.User {
+			case "ro":
+				auth.ReplyCh <- client_connection.AuthReply{OK: true, Home: "2", ReadOnly: true}
+			default:
+				auth.ReplyCh <- client_connection.AuthReply{OK: true, Home: "missing"}
+			}
+		}
+	}()
+	if err := ioutil.WriteFile(root+"/2/account_file", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(root + "/2/account_file")
+	mountRoot, err := ioutil.TempDir("", "ftp_mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountRoot)
+	if err := ioutil.WriteFile(mountRoot+"/upload", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc, buf := scriptCC("USER nohome\r\nPASS pass\r\nUSER ro\r\nPASS pass\r\nDELE account_file\r\nCWD /2\r\n"+
+		"DELE /uploads/upload\r\nRNFR /uploads/upload\r\nSITE CHMOD 600 /uploads/upload\r\n", authCh)
+	// The mount is writable, but not for read-only accounts.
+	cc.SetMounts([]ftp_path.Mount{{Path: "/uploads", Root: mountRoot}})
+
+	actual := runScript(t, cc, buf)
+	expected := "331 Password required for nohome.\n530 Login failed.\n331 Password required for ro.\n" +
+		"230 User logged in.\n550 Permission denied.\n550 Invalid path.\n" +
+		"550 Permission denied.\n550 Permission denied.\n550 Permission denied.\n"
+	if actual != expected {
+		t.Errorf("Error actual = %q, and Expected = %q.", actual, expected)
+	}
+	for _, path := range []string{root + "/2/account_file", mountRoot + "/upload"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+	}
+}
+
+func TestCertificateUser(t *testing.T) {
+	initCC()
+	authCh := make(chan client_connection.AuthPkg)
+	defer close(authCh)
+	go func() {
+		for auth := range authCh {
+			switch {
+			case !auth.Certificate || auth.Password != "":
+				auth.ReplyCh <- client_connection.AuthReply{}
+			case auth.User == "backup":
+				auth.ReplyCh <- client_connection.AuthReply{OK: true, Home: "2", ReadOnly: true}
+			default:
+				auth.ReplyCh <- client_connection.AuthReply{}
+			}
+		}
+	}()
+	if err := ioutil.WriteFile(root+"/2/cert_file", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(root + "/2/cert_file")
+	tests := []struct {
+		certUser string
+		script   string
+		expected string
+	}{
+		{"backup", "USER user\r\nPWD\r\nUSER backup\r\nPWD\r\nDELE cert_file\r\n",
+			"331 Password required for user.\n530 Please login with USER and PASS.\n" +
+				"232 User logged in, authorized by security data exchange.\n257 \"/\" is current directory.\n" +
+				"550 Permission denied.\n"},
+		// Refused certificate logins, e.g. of users that need a TOTP code, fall back to PASS.
+		{"refused", "USER refused\r\nPWD\r\n",
+			"331 Password required for refused.\n530 Please login with USER and PASS.\n"},
+	}
+	for _, test := range tests {
+		cc, buf := scriptCC(test.script, authCh)
+		cc.SetCertificateUser(test.certUser)
+
+		actual := runScript(t, cc, buf)
+		if actual != test.expected {
+			t.Errorf("Error actual = %q, and Expected = %q.", actual, test.expected)
+		}
+	}
+	if _, err := os.Stat(root + "/2/cert_file"); err != nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+	}
+}
+
+func TestInvalidCommands(t *testing.T) {
+	_, _, authCh := initCC()
+	defer close(authCh)
+	cc, buf := scriptCC("XYZZY\r\nRETR\r\n"+strings.Repeat("A", ftp_cmd.MaxLineLength+1)+"\r\npwd\r\n", authCh)
+
+	actual := runScript(t, cc, buf)
+	expected := "500 'XYZZY': command not understood.\n501 Syntax error in parameters or arguments.\n" +
+		"500 Command line too long.\n530 Please login with USER and PASS.\n"
+	if actual != expected {
+		t.Errorf("Error actual = %q, and Expected = %q.", actual, expected)
+	}
+}
+
 func initCC() (*client_connection.ClientConnection, *bytes.Buffer, chan client_connection.AuthPkg) {
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		os.Mkdir(root, os.ModePerm)
@@ -554,7 +1601,7 @@ func initCC() (*client_connection.ClientConnection, *bytes.Buffer, chan client_c
 	authChan := make(chan client_connection.AuthPkg)
 	go func() {
 		for auth := range authChan {
-			auth.ReplyCh <- auth.User == "user" && auth.Password == "pass"
+			auth.ReplyCh <- client_connection.AuthReply{OK: auth.User == "user" && auth.Password == "pass"}
 		}
 	}()
 	buf := make([]byte, 0, 1024)
@@ -563,6 +1610,30 @@ func initCC() (*client_connection.ClientConnection, *bytes.Buffer, chan client_c
 	return cc, bytesBuf, authChan
 }
 
+// scriptCC returns a connection that reads its commands from script and writes its replies to the returned
+// buffer.
+func scriptCC(script string, authCh chan client_connection.AuthPkg) (*client_connection.ClientConnection, *bytes.Buffer) {
+	var buf bytes.Buffer
+	cc := client_connection.New(struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(script), &buf}, authCh, root, "127.0.0.1")
+	return cc, &buf
+}
+
+// runScript replies to the commands of cc until its script is exhausted and returns the replies.
+func runScript(t *testing.T, cc *client_connection.ClientConnection, buf *bytes.Buffer) string {
+	for {
+		cmd, err := cc.Command()
+		if err != nil {
+			return buf.String()
+		}
+		if err := cc.Reply(cmd); err != nil {
+			t.Errorf("Error actual = %v, and Expected = %v.", err, nil)
+		}
+	}
+}
+
 func authenticate(cc *client_connection.ClientConnection, buf *bytes.Buffer) {
 	if err := cc.Reply(&ftp_cmd.Cmd{Type: ftp_cmd.USER, Arg: "user"}); err != nil {
 		log.Fatal(err)
@@ -574,11 +1645,11 @@ func authenticate(cc *client_connection.ClientConnection, buf *bytes.Buffer) {
 }
 
 func listenDataConn(addr string, wg *sync.WaitGroup, action func(net.Conn)) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	go func() {
-		ln, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatal(err)
-		}
 		conn, err := ln.Accept()
 		if err != nil {
 			return
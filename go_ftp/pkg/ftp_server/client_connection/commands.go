@@ -0,0 +1,72 @@
+package client_connection
+
+import (
+	"io"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hooks"
+)
+
+// Handler handles a custom command registered with ftp_cmd.Register. It must send a reply through ctx, a
+// returned error means that the reply couldn't be sent.
+type Handler func(ctx *Context, cmd *ftp_cmd.Cmd) error
+
+// Context gives the handler of a custom command access to the session that received the command.
+type Context struct {
+	cc *ClientConnection
+}
+
+// Session returns the user and remote address of the session, the user is empty before logging in.
+func (ctx *Context) Session() ftp_hooks.Session {
+	return ctx.cc.Session()
+}
+
+// Cwd returns the current directory of the session.
+func (ctx *Context) Cwd() string {
+	return ctx.cc.dirPath.current
+}
+
+// Reply sends a reply with the given status code.
+func (ctx *Context) Reply(status int, text string) error {
+	return ctx.cc.send(status, text)
+}
+
+// ReplyMultiline sends a multiline reply, lines are indented with a space.
+func (ctx *Context) ReplyMultiline(status int, first string, lines []string, last string) error {
+	return ctx.cc.sendMultiline(status, first, lines, last)
+}
+
+// ReplyError sends the reply of an ftp_error.ReplyError, or 451 for other errors.
+func (ctx *Context) ReplyError(err error) error {
+	return ctx.cc.sendError(err)
+}
+
+// Resolve returns the host path of a path given by the client, relative paths are relative to Cwd. It
+// returns an ftp_error.InvalidPathError if the path is outside of the root directory.
+func (ctx *Context) Resolve(path string) (string, error) {
+	return ctx.cc.getFilePath(path)
+}
+
+// Writable reports whether the client may change path, i.e. it isn't in a read-only mount.
+func (ctx *Context) Writable(path string) bool {
+	return ctx.cc.dirPath.writable(path)
+}
+
+// Transfer sends the preliminary 150 reply with msg and runs action on the data connection set up with PASV,
+// EPSV, PORT or EPRT. The data connection is closed when action returns, the final reply is left to the
+// handler, e.g.
+//
+//	if err := ctx.Transfer("Opening data connection.", send); err != nil {
+//		return ctx.ReplyError(err)
+//	}
+//	return ctx.Reply(226, "Transfer complete.")
+func (ctx *Context) Transfer(msg string, action func(rw io.ReadWriter) error) error {
+	return ctx.cc.transfer(msg, func(t *dataTransfer) error {
+		return action(t)
+	})
+}
+
+// SetCommands sets the handlers of custom commands.
+func (cc *ClientConnection) SetCommands(handlers map[ftp_cmd.CmdType]Handler) {
+	cc.handlers = handlers
+}
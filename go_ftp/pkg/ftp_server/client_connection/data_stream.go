@@ -0,0 +1,125 @@
+package client_connection
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// dataStream is a data connection which transparently compresses and decompresses the transferred
+// data when MODE Z is used.
+type dataStream struct {
+	conn     net.Conn
+	compress bool
+	level    int
+	zr       io.ReadCloser
+	zw       *zlib.Writer
+	closed   bool
+}
+
+func newDataStream(conn net.Conn, compress bool, level int) *dataStream {
+	return &dataStream{
+		conn:     conn,
+		compress: compress,
+		level:    level,
+	}
+}
+
+func (ds *dataStream) Read(p []byte) (int, error) {
+	if !ds.compress {
+		return ds.conn.Read(p)
+	}
+	if ds.zr == nil {
+		zr, err := zlib.NewReader(ds.conn)
+		if err != nil {
+			return 0, err
+		}
+		ds.zr = zr
+	}
+	return ds.zr.Read(p)
+}
+
+func (ds *dataStream) Write(p []byte) (int, error) {
+	if !ds.compress {
+		return ds.conn.Write(p)
+	}
+	if ds.zw == nil {
+		zw, err := zlib.NewWriterLevel(ds.conn, ds.level)
+		if err != nil {
+			return 0, err
+		}
+		ds.zw = zw
+	}
+	return ds.zw.Write(p)
+}
+
+// Close flushes any compressed data and closes the underlying connection. It is safe to call Close more than once.
+func (ds *dataStream) Close() error {
+	if ds.closed {
+		return nil
+	}
+	ds.closed = true
+	var err error
+	if ds.zw != nil {
+		err = ds.zw.Close()
+	}
+	if ds.zr != nil {
+		ds.zr.Close()
+	}
+	if cerr := ds.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dataTransfer lets a command handler use the data connection, which is served by another goroutine, as an
+// io.ReadWriteCloser. Errors on the data connection are returned as *ftp_error.TransferAbortedError.
+type dataTransfer struct {
+	ch       chan dataPackage
+	reply    chan dataResult
+	status   *sessionStatus
+	compress bool
+	level    int
+	// tlsConfig protects the data connection with TLS if it isn't nil.
+	tlsConfig *tls.Config
+}
+
+func (t *dataTransfer) Read(p []byte) (int, error) {
+	result := t.do('r', p)
+	if result.err != nil {
+		return result.n, &ftp_error.TransferAbortedError{Err: result.err}
+	}
+	if result.n == 0 {
+		return 0, io.EOF
+	}
+	return result.n, nil
+}
+
+func (t *dataTransfer) Write(p []byte) (int, error) {
+	result := t.do('w', p)
+	if result.err != nil {
+		return result.n, &ftp_error.TransferAbortedError{Err: result.err}
+	}
+	return result.n, nil
+}
+
+// Close flushes and closes the data connection.
+func (t *dataTransfer) Close() error {
+	if result := t.do('c', nil); result.err != nil {
+		return &ftp_error.TransferAbortedError{Err: result.err}
+	}
+	return nil
+}
+
+func (t *dataTransfer) do(action byte, payload []byte) dataResult {
+	t.ch <- dataPackage{action: action, payload: payload, compress: t.compress, level: t.level,
+		tlsConfig: t.tlsConfig, reply: t.reply}
+	result := <-t.reply
+	if t.status != nil {
+		t.status.addTransferred(result.n)
+	}
+	return result
+}
@@ -1,21 +1,66 @@
 package client_connection
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
 )
 
 type ftpDirPath struct {
-	root    string
-	current string
+	resolver *ftp_path.Resolver
+	current  string
+}
+
+func (fd *ftpDirPath) root() string {
+	return fd.resolver.Root()
 }
 
 func (fd *ftpDirPath) path() string {
-	return fd.root + fd.current
+	_, host, err := fd.resolve(".")
+	if err != nil {
+		return fd.root()
+	}
+	return host
+}
+
+// resolve returns the virtual and host path of a path sent by the client.
+func (fd *ftpDirPath) resolve(path string) (string, string, error) {
+	return fd.resolver.Resolve(fd.current, path)
+}
+
+// writable reports whether path may be created, changed or removed.
+func (fd *ftpDirPath) writable(path string) bool {
+	virtual, _, err := fd.resolve(path)
+	return err == nil && fd.resolver.Writable(virtual)
+}
+
+// listMounts returns "ls -l" lines for the mount points in the current directory that don't exist in the
+// host directory, so that they show up in listings.
+func (fd *ftpDirPath) listMounts() []byte {
+	var lines []byte
+	for _, m := range fd.resolver.MountsIn(fd.current) {
+		name := path.Base(m.Path)
+		if fileExist(filepath.Join(fd.path(), name)) {
+			continue
+		}
+		info, err := os.Stat(m.Root)
+		if err != nil {
+			continue
+		}
+		line := fmt.Sprintf("%s 1 ftp ftp %d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), name)
+		lines = append(lines, line...)
+	}
+	return lines
 }
 
 func (fd *ftpDirPath) exist(path string) bool {
-	return fileExist(filepath.Join(fd.root, path))
+	_, host, err := fd.resolve(path)
+	return err == nil && fileExist(host)
 }
 
 func fileExist(path string) bool {
@@ -24,3 +69,26 @@ func fileExist(path string) bool {
 	}
 	return true
 }
+
+// fileUsage returns the size and file count that path contributes to a quota.
+func fileUsage(path string) (int64, int64) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, 0
+	}
+	return info.Size(), 1
+}
+
+// uniqueName returns a file name that doesn't exist in dir.
+func uniqueName(dir string) (string, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		name := "stou-" + hex.EncodeToString(b)
+		if !fileExist(filepath.Join(dir, name)) {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package client_connection
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
+)
+
+// VirtualHost is a host that clients can select with HOST (RFC 7151) before logging in.
+type VirtualHost struct {
+	// Root is the root directory of the host.
+	Root string
+	// Welcome is the text of the 220 reply to HOST, it may span several lines.
+	Welcome string
+}
+
+// SetVirtualHosts sets the virtual hosts, keyed by their names as returned by HostName.
+func (cc *ClientConnection) SetVirtualHosts(hosts map[string]VirtualHost) {
+	cc.hosts = hosts
+}
+
+// HostName returns the canonical form of a HOST argument: domain names are lower case without trailing dot
+// and IPv6 literals lose their brackets.
+func HostName(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		return name[1 : len(name)-1]
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Private Methods
+
+// handleHostCMD selects a virtual host, which is only allowed before USER. The session gets the root
+// directory of the host, mounts only apply to the default host.
+func (cc *ClientConnection) handleHostCMD(cmd *ftp_cmd.Cmd) error {
+	if cc.isAuth {
+		return cc.send(503, "Already logged in.")
+	}
+	if cc.user != "" {
+		return cc.send(503, "HOST must be sent before USER.")
+	}
+	name := HostName(cmd.Arg)
+	host, ok := cc.hosts[name]
+	if !ok {
+		return cc.send(504, fmt.Sprintf("Unknown host %s.", cmd.Arg))
+	}
+	cc.host = name
+	cc.dirPath = ftpDirPath{ftp_path.NewResolver(host.Root, cc.dirPath.resolver.FollowSymlinks()), "/"}
+	welcome := host.Welcome
+	if welcome == "" {
+		welcome = fmt.Sprintf("Service ready for %s.", name)
+	}
+	lines := strings.Split(strings.TrimRight(welcome, "\n"), "\n")
+	if len(lines) == 1 {
+		return cc.send(220, lines[0])
+	}
+	return cc.sendMultiline(220, lines[0], lines[1:len(lines)-1], lines[len(lines)-1])
+}
@@ -0,0 +1,59 @@
+package client_connection
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+)
+
+// SetTLSConfig sets the TLS config of the control connection if it is protected with TLS. Clients can then
+// protect the data connections too with "PBSZ 0" and "PROT P" (RFC 4217), the server is the TLS server of
+// the data connections in both passive and active mode.
+func (cc *ClientConnection) SetTLSConfig(config *tls.Config) {
+	cc.tlsConfig = config
+}
+
+// Private Methods
+
+// handlePbszCMD accepts the only protection buffer size that TLS allows, which is 0.
+func (cc *ClientConnection) handlePbszCMD(cmd *ftp_cmd.Cmd) error {
+	if cc.tlsConfig == nil {
+		return cc.send(503, "PBSZ requires a TLS protected control connection.")
+	}
+	cc.pbsz = true
+	// Other sizes are answered with the size that is used, RFC 4217 section 8.
+	if cmd.Arg != "0" {
+		return cc.send(200, "PBSZ=0")
+	}
+	return cc.send(200, "PBSZ command successful.")
+}
+
+// handleProtCMD sets the protection level of the following transfers, C for clear or P for private.
+func (cc *ClientConnection) handleProtCMD(cmd *ftp_cmd.Cmd) error {
+	if cc.tlsConfig == nil {
+		return cc.send(503, "PROT requires a TLS protected control connection.")
+	}
+	if !cc.pbsz {
+		return cc.send(503, "PROT requires PBSZ first.")
+	}
+	switch strings.ToUpper(cmd.Arg) {
+	case "C":
+		cc.protect = false
+	case "P":
+		cc.protect = true
+	case "S", "E":
+		return cc.send(536, "Requested protection level not supported.")
+	default:
+		return cc.send(504, "Command not implemented for that parameter.")
+	}
+	return cc.send(200, "Protection level set to "+strings.ToUpper(cmd.Arg)+".")
+}
+
+// dataTLSConfig returns the TLS config of the data connections, or nil if they aren't protected.
+func (cc *ClientConnection) dataTLSConfig() *tls.Config {
+	if !cc.protect {
+		return nil
+	}
+	return cc.tlsConfig
+}
@@ -0,0 +1,190 @@
+package client_connection
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+)
+
+// siteCommands are the built-in SITE subcommands.
+var siteCommands = []string{"CHMOD", "HELP", "QUOTA", "UTIME", "WHO"}
+
+// The time format of SITE UTIME.
+const utimeLayout = "20060102150405"
+
+// SetSiteCommands sets the handlers of custom SITE subcommands. The handlers receive the subcommand in upper
+// case as cmd.Type and its arguments as cmd.Arg.
+func (cc *ClientConnection) SetSiteCommands(handlers map[string]Handler) {
+	cc.siteHandlers = handlers
+}
+
+// SetAdmins sets the users that are allowed to use administrative SITE commands such as WHO.
+func (cc *ClientConnection) SetAdmins(users map[string]bool) {
+	cc.admins = users
+}
+
+// SetSessions sets a function that returns the sessions of the server, which are listed by SITE WHO.
+func (cc *ClientConnection) SetSessions(sessions func() []Status) {
+	cc.sessions = sessions
+}
+
+// IsSiteCommand reports whether name is a built-in SITE subcommand.
+func IsSiteCommand(name string) bool {
+	for _, builtin := range siteCommands {
+		if strings.EqualFold(name, builtin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Private Methods
+
+func (cc *ClientConnection) handleSiteCMD(cmd *ftp_cmd.Cmd) error {
+	args := strings.SplitN(strings.TrimLeft(cmd.Arg, " "), " ", 2)
+	if args[0] == "" {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	sub := &ftp_cmd.Cmd{Type: ftp_cmd.CmdType(strings.ToUpper(args[0]))}
+	if len(args) == 2 {
+		sub.Arg = args[1]
+	}
+	switch sub.Type {
+	case "QUOTA":
+		return cc.handleSiteQuotaCMD()
+	case "CHMOD":
+		return cc.handleSiteChmodCMD(sub)
+	case "UTIME":
+		return cc.handleSiteUtimeCMD(sub)
+	case "WHO":
+		return cc.handleSiteWhoCMD()
+	case "HELP":
+		return cc.handleSiteHelpCMD()
+	}
+	if handler, ok := cc.siteHandlers[string(sub.Type)]; ok {
+		return handler(&Context{cc}, sub)
+	}
+	return cc.send(504, fmt.Sprintf("'SITE %s': command not implemented.", args[0]))
+}
+
+func (cc *ClientConnection) handleSiteQuotaCMD() error {
+	quota, usage, ok := cc.quota.Report(cc.user)
+	if !ok {
+		return cc.send(200, fmt.Sprintf("No quota for %s.", cc.user))
+	}
+	return cc.send(200, fmt.Sprintf("Quota for %s: %d/%s bytes, %d/%s files.", cc.user,
+		usage.Bytes, quotaLimit(quota.MaxBytes), usage.Files, quotaLimit(quota.MaxFiles)))
+}
+
+// handleSiteChmodCMD handles "SITE CHMOD <mode> <path>", the mode is octal and may only contain the
+// permission bits.
+func (cc *ClientConnection) handleSiteChmodCMD(cmd *ftp_cmd.Cmd) error {
+	args := strings.SplitN(cmd.Arg, " ", 2)
+	if len(args) != 2 || args[1] == "" {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return cc.send(501, fmt.Sprintf("Invalid mode %s.", args[0]))
+	}
+	path, err := cc.getFilePathIfExist(args[1])
+	if err != nil {
+		return cc.sendError(&ftp_error.FileNotFoundError{File: args[1]})
+	}
+	if !cc.dirPath.writable(args[1]) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: args[1]})
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: args[1]})
+	}
+	return cc.send(200, "SITE CHMOD command successful.")
+}
+
+// handleSiteUtimeCMD handles "SITE UTIME <YYYYMMDDhhmmss> <path>" and the "SITE UTIME <path> <atime>
+// <mtime> <ctime> UTC" form used by some clients. The times are UTC, the ctime is ignored.
+func (cc *ClientConnection) handleSiteUtimeCMD(cmd *ftp_cmd.Cmd) error {
+	name, atime, mtime, err := parseUtime(cmd.Arg)
+	if err != nil {
+		return cc.send(501, "Syntax error in parameters or arguments.")
+	}
+	path, err := cc.getFilePathIfExist(name)
+	if err != nil {
+		return cc.sendError(&ftp_error.FileNotFoundError{File: name})
+	}
+	if !cc.dirPath.writable(name) {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: name})
+	}
+	if err := os.Chtimes(path, atime, mtime); err != nil {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: name})
+	}
+	return cc.send(200, "SITE UTIME command successful.")
+}
+
+func (cc *ClientConnection) handleSiteWhoCMD() error {
+	if !cc.admins[cc.user] || cc.sessions == nil {
+		return cc.sendError(&ftp_error.PermissionDeniedError{Path: "SITE WHO"})
+	}
+	sessions := cc.sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].User != sessions[j].User {
+			return sessions[i].User < sessions[j].User
+		}
+		return sessions[i].RemoteAddr < sessions[j].RemoteAddr
+	})
+	lines := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		user := s.User
+		if user == "" {
+			user = "-"
+		}
+		line := fmt.Sprintf("%-16s %-24s idle %-8s %s", user, s.RemoteAddr, s.Idle.Truncate(time.Second), s.Cwd)
+		if s.Transfer != "" {
+			line += " " + s.Transfer
+		}
+		lines = append(lines, line)
+	}
+	return cc.sendMultiline(200, "Sessions:", lines, fmt.Sprintf("%d sessions.", len(sessions)))
+}
+
+func (cc *ClientConnection) handleSiteHelpCMD() error {
+	names := append([]string{}, siteCommands...)
+	for name := range cc.siteHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return cc.sendMultiline(214, "The following SITE commands are recognized:", names, "Help OK.")
+}
+
+// parseUtime parses the arguments of SITE UTIME and returns the path and the access and modification times.
+func parseUtime(arg string) (string, time.Time, time.Time, error) {
+	fields := strings.Fields(arg)
+	if n := len(fields); n >= 5 && strings.EqualFold(fields[n-1], "UTC") {
+		atime, aerr := time.Parse(utimeLayout, fields[n-4])
+		mtime, merr := time.Parse(utimeLayout, fields[n-3])
+		if aerr == nil && merr == nil {
+			name := strings.TrimSuffix(strings.TrimRight(arg, " "), " "+strings.Join(fields[n-4:], " "))
+			if name != "" && name != arg {
+				return name, atime, mtime, nil
+			}
+		}
+	}
+	args := strings.SplitN(arg, " ", 2)
+	if len(args) != 2 || args[1] == "" {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("Invalid UTIME arguments %s", arg)
+	}
+	layout := utimeLayout
+	if len(args[0]) == len("200601021504") {
+		layout = "200601021504"
+	}
+	mtime, err := time.Parse(layout, args[0])
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	return args[1], mtime, mtime, nil
+}
@@ -0,0 +1,117 @@
+package client_connection
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
+)
+
+// Status is a snapshot of a session, used to administrate the server.
+type Status struct {
+	User       string
+	RemoteAddr string
+	Cwd        string
+	// Transfer is the data command in progress, e.g. "RETR file.txt", or empty.
+	Transfer    string
+	Transferred int64
+	// Size is the size of the file being transferred or -1 if it isn't known.
+	Size int64
+	Idle time.Duration
+}
+
+// sessionStatus is the part of the session state that is read by other goroutines than the one serving
+// the session.
+type sessionStatus struct {
+	mu          sync.Mutex
+	user        string
+	cwd         string
+	lastActive  time.Time
+	transfer    string
+	transferred int64
+	size        int64
+	dataConn    io.Closer
+	closed      bool
+}
+
+func (s *sessionStatus) begin(cmd *ftp_cmd.Cmd) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+	if cmd.Type.IsDataCMD() {
+		s.transfer = string(cmd.Type)
+		if cmd.Arg != "" {
+			s.transfer += " " + cmd.Arg
+		}
+		s.transferred = 0
+		s.size = -1
+	}
+}
+
+func (s *sessionStatus) end(user, cwd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+	s.user = user
+	s.cwd = cwd
+	s.transfer = ""
+}
+
+func (s *sessionStatus) setSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+}
+
+func (s *sessionStatus) addTransferred(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transferred += int64(n)
+}
+
+// setDataConn records the open data connection, or passive listener, so that it can be closed when the
+// session is closed.
+func (s *sessionStatus) setDataConn(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataConn = conn
+	if s.closed && conn != nil {
+		conn.Close()
+	}
+}
+
+// Status returns a snapshot of the session.
+func (cc *ClientConnection) Status() Status {
+	s := &cc.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := Status{
+		User:       s.user,
+		RemoteAddr: cc.remoteAddr(),
+		Cwd:        s.cwd,
+		Idle:       time.Since(s.lastActive),
+		Size:       -1,
+	}
+	if s.transfer != "" {
+		status.Transfer, status.Transferred, status.Size = s.transfer, s.transferred, s.size
+	}
+	return status
+}
+
+// Close closes the control connection and any open data connection or passive listener, aborting the
+// session. The file locks held by the session are released.
+func (cc *ClientConnection) Close() error {
+	defer cc.locks.ReleaseAll()
+	s := &cc.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.dataConn != nil {
+		s.dataConn.Close()
+	}
+	if closer, ok := cc.ctrlConn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -1,12 +1,35 @@
 package ftp_server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/text/encoding"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_admin"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_charset"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_cmd"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_error"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_filter"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_hooks"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_lock"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_path"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_proxy"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_quota"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_record"
 	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server/client_connection"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_totp"
 )
 
 type FtpServer struct {
@@ -15,9 +38,43 @@ type FtpServer struct {
 	ip        string
 	users     map[string]string
 	usrAuthCh chan client_connection.AuthPkg
-	listener  net.Listener
+	listeners []net.Listener
+	authOnce  sync.Once
+	hooks     ftp_hooks.Hooks
+	quota     *ftp_quota.Manager
+	symlinks  bool
+	fxpUsers  map[string]bool
+	anyPasvIP bool
+	proxies   ftp_proxy.Trusted
+	mounts    []ftp_path.Mount
+	locks     *ftp_lock.Manager
+	recordDir string
+	handlers  map[ftp_cmd.CmdType]client_connection.Handler
+	site      map[string]client_connection.Handler
+	admins    map[string]bool
+	charset   encoding.Encoding
+	hosts     map[string]client_connection.VirtualHost
+	hostUsers map[string]map[string]string
+	totp      map[totpUser]string
+	totpUsed  map[totpUser]int64
+	totpMu    sync.Mutex
+	auth      ftp_auth.Authenticator
+	tlsConfig *tls.Config
+	certs     *ftp_auth.CertMapper
+	uploads   *ftp_filter.Filter
+
+	sessionsMu  sync.Mutex
+	sessions    map[uint64]*client_connection.ClientConnection
+	nextID      uint64
+	maintenance int32
 }
 
+// The time a proxy has to send the PROXY protocol header after connecting.
+const proxyHeaderTimeout = 5 * time.Second
+
+// The time a client has to complete the TLS handshake after connecting.
+const tlsHandshakeTimeout = 10 * time.Second
+
 // Public Methods
 
 func New(root, ip, port string) *FtpServer {
@@ -27,45 +84,401 @@ func New(root, ip, port string) *FtpServer {
 		ip:        ip,
 		users:     map[string]string{"demo": "password"},
 		usrAuthCh: make(chan client_connection.AuthPkg),
+		hooks:     ftp_hooks.NopHooks{},
+		quota:     ftp_quota.NewManager(),
+		locks:     ftp_lock.NewManager(ftp_lock.Reject, 0),
+		fxpUsers:  make(map[string]bool),
+		sessions:  make(map[uint64]*client_connection.ClientConnection),
+		handlers:  make(map[ftp_cmd.CmdType]client_connection.Handler),
+		site:      make(map[string]client_connection.Handler),
+		admins:    make(map[string]bool),
+		hosts:     make(map[string]client_connection.VirtualHost),
+		hostUsers: make(map[string]map[string]string),
+		totp:      make(map[totpUser]string),
+		totpUsed:  make(map[totpUser]int64),
 	}
 }
 
+// SetHooks registers the callbacks that are invoked on session events. Must be called before Start.
+func (ftpserver *FtpServer) SetHooks(hooks ftp_hooks.Hooks) {
+	ftpserver.hooks = hooks
+}
+
 func (ftpserver *FtpServer) Start() error {
 	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%s", ftpserver.ip, ftpserver.port))
 	if err != nil {
 		return err
 	}
-	ftpserver.listener = ln
-	go ftpserver.startAuthChannel()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println(err.Error())
-			break
-		}
-		log.Printf("New connection accepted from %s.\n", conn.RemoteAddr())
-		go ftpserver.handle(conn)
+	return ftpserver.Serve(ln)
+}
+
+// Serve accepts connections on already opened listeners, e.g. listeners passed by systemd socket
+// activation, until Stop is called.
+func (ftpserver *FtpServer) Serve(listeners ...net.Listener) error {
+	ftpserver.listeners = listeners
+	ftpserver.authOnce.Do(func() { go ftpserver.startAuthChannel() })
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			ftpserver.accept(ln)
+		}(ln)
 	}
+	wg.Wait()
 	return nil
 }
 
+// ServeConn serves a single session on conn and returns when it ends, which is how the server runs under
+// inetd.
+func (ftpserver *FtpServer) ServeConn(conn net.Conn) {
+	ftpserver.authOnce.Do(func() { go ftpserver.startAuthChannel() })
+	ftpserver.handle(conn)
+}
+
 func (ftpserver *FtpServer) Stop() {
-	ftpserver.listener.Close()
+	for _, ln := range ftpserver.listeners {
+		ln.Close()
+	}
 	close(ftpserver.usrAuthCh)
 }
 
+// Handle adds the custom command verb, e.g. "XSTATS", which is handled by handler. The spec tells whether
+// the command takes an argument and whether it can be used before logging in. The built-in commands can't
+// be replaced. Must be called before Start.
+func (ftpserver *FtpServer) Handle(verb string, spec ftp_cmd.Spec, handler client_connection.Handler) error {
+	if err := ftp_cmd.Register(ftp_cmd.CmdType(verb), spec); err != nil {
+		return err
+	}
+	ftpserver.handlers[ftp_cmd.CmdType(strings.ToUpper(verb))] = handler
+	return nil
+}
+
+// HandleSite adds the custom SITE subcommand name, e.g. "SITE REINDEX", which is handled by handler. The
+// built-in subcommands can't be replaced. Must be called before Start.
+func (ftpserver *FtpServer) HandleSite(name string, handler client_connection.Handler) error {
+	name = strings.ToUpper(name)
+	if name == "" || strings.Contains(name, " ") {
+		return fmt.Errorf("Invalid SITE command %s", name)
+	}
+	if _, ok := ftpserver.site[name]; ok || client_connection.IsSiteCommand(name) {
+		return fmt.Errorf("SITE command %s is already registered", name)
+	}
+	ftpserver.site[name] = handler
+	return nil
+}
+
+// SetAdmins allows users to use administrative SITE commands, such as SITE WHO which lists the sessions.
+func (ftpserver *FtpServer) SetAdmins(users ...string) {
+	for _, user := range users {
+		ftpserver.admins[user] = true
+	}
+}
+
+// SetFallbackCharset sets the charset, e.g. "ISO-8859-1", used for file names with clients that don't send
+// "OPTS UTF8 ON". By default file names are UTF-8.
+func (ftpserver *FtpServer) SetFallbackCharset(name string) error {
+	charset, err := ftp_charset.Lookup(name)
+	if err != nil {
+		return err
+	}
+	ftpserver.charset = charset
+	return nil
+}
+
+// AddHost adds the virtual host name, which clients select with HOST before logging in. The host has its
+// own root directory, users, mapping user names to passwords, and welcome banner. Clients that don't send
+// HOST get the default host. Must be called before Start.
+func (ftpserver *FtpServer) AddHost(name, root string, users map[string]string, welcome string) error {
+	name = client_connection.HostName(name)
+	if name == "" {
+		return fmt.Errorf("Empty host name")
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("Host root %s is not a directory", root)
+	}
+	ftpserver.hosts[name] = client_connection.VirtualHost{Root: root, Welcome: welcome}
+	ftpserver.hostUsers[name] = users
+	return nil
+}
+
+// SetAuthenticator makes logins be checked by an external authenticator, e.g. ftp_auth.NewHTTP wrapped in
+// ftp_auth.NewCache, instead of the built-in users. The authenticator may set the home directory and
+// permissions of the session. TOTP codes are still checked by the server. Must be called before Start.
+func (ftpserver *FtpServer) SetAuthenticator(auth ftp_auth.Authenticator) {
+	ftpserver.auth = auth
+}
+
+// SetTLSConfig protects control connections with implicit TLS, the handshake starts as soon as the client
+// connects. Data connections are only protected if the client sends "PBSZ 0" and "PROT P" (RFC 4217). Must
+// be called before Start.
+func (ftpserver *FtpServer) SetTLSConfig(config *tls.Config) {
+	ftpserver.tlsConfig = config
+}
+
+// SetCertificateMapper lets clients with a TLS client certificate that mapper maps to a user log in as that
+// user with USER alone, which is answered with 232. The login still goes through the authenticator, or the
+// users of the selected virtual host, and users with a TOTP secret are asked for PASS. The TLS config must
+// request client certificates, e.g. with tls.VerifyClientCertIfGiven. Must be called before Start.
+func (ftpserver *FtpServer) SetCertificateMapper(mapper *ftp_auth.CertMapper) {
+	ftpserver.certs = mapper
+}
+
+// SetTOTP requires user of the virtual host, or of the default host if host is empty, to log in with a
+// second factor: PASS carries the password immediately followed by the current TOTP (RFC 6238) code
+// generated from the base32 encoded secret. Each code can only be used once. Must be called before Start.
+func (ftpserver *FtpServer) SetTOTP(host, user, secret string) error {
+	if _, err := ftp_totp.Code(secret, time.Now()); err != nil {
+		return err
+	}
+	ftpserver.totp[totpUser{client_connection.HostName(host), user}] = secret
+	return nil
+}
+
+// SetUploadRules restricts the names and sizes of uploaded files, see ftp_filter.Rule. Uploads that exceed
+// the maximum size are aborted with 552.
+func (ftpserver *FtpServer) SetUploadRules(rules ...ftp_filter.Rule) {
+	ftpserver.uploads = ftp_filter.New(rules...)
+}
+
+// SetQuota limits the number of bytes and files user may store in its home directory, zero values mean
+// unlimited. Files in mounts outside the home directory are not counted.
+func (ftpserver *FtpServer) SetQuota(user string, quota ftp_quota.Quota) {
+	ftpserver.quota.SetQuota(user, quota)
+}
+
+// SetFollowSymlinks allows sessions to follow symlinks that point outside of the root directory.
+func (ftpserver *FtpServer) SetFollowSymlinks(follow bool) {
+	ftpserver.symlinks = follow
+}
+
+// AllowFXP allows users to do server to server (FXP) transfers. By default PORT and EPRT are only accepted
+// if they point to the client's own address.
+func (ftpserver *FtpServer) AllowFXP(users ...string) {
+	for _, user := range users {
+		ftpserver.fxpUsers[user] = true
+	}
+}
+
+// AllowAnyPassiveIP disables the check that passive data connections come from the same IP as the control
+// connection, which is needed if clients connect through proxies that use different addresses. The check
+// is the only protection of passive data connections against hijacking, TLS sessions aren't checked for
+// reuse.
+func (ftpserver *FtpServer) AllowAnyPassiveIP(allow bool) {
+	ftpserver.anyPasvIP = allow
+}
+
+// Mount makes the host directory root available to clients as the virtual directory dir, e.g. "/releases".
+// Clients can't create, change or remove anything in read-only mounts, nor the mount point itself. The parent
+// of dir should exist in the root directory or in another mount for clients to be able to navigate to it.
+func (ftpserver *FtpServer) Mount(dir, root string, readOnly bool) error {
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("Mount point %s is not an absolute path", dir)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("Mount root %s is not a directory", root)
+	}
+	ftpserver.mounts = append(ftpserver.mounts, ftp_path.Mount{Path: path.Clean(dir), Root: root, ReadOnly: readOnly})
+	return nil
+}
+
+// SetLockPolicy decides what happens when a session deletes or renames a file that other sessions are
+// downloading: reject it with 450 (the default), or wait up to wait for the downloads to finish.
+func (ftpserver *FtpServer) SetLockPolicy(policy ftp_lock.Policy, wait time.Duration) {
+	ftpserver.locks = ftp_lock.NewManager(policy, wait)
+}
+
+// SetRecordDir enables recording of the control connection of every session to a transcript file in dir.
+// Passwords are redacted. The transcripts can be replayed with the ftp_replay command.
+func (ftpserver *FtpServer) SetRecordDir(dir string) {
+	ftpserver.recordDir = dir
+}
+
+// SetTrustedProxies enables the PROXY protocol (version 1 and 2) for connections from the given IP addresses
+// or CIDR networks, so that sessions see the address of the real client. Connections from other addresses
+// are treated as direct connections. Passive data connections usually come from the proxy too, which might
+// require AllowAnyPassiveIP.
+func (ftpserver *FtpServer) SetTrustedProxies(proxies ...string) error {
+	trusted, err := ftp_proxy.ParseTrusted(proxies...)
+	if err != nil {
+		return err
+	}
+	ftpserver.proxies = trusted
+	return nil
+}
+
+// StartAdmin serves the admin HTTP API (see ftp_admin.NewHandler) on addr in the background. token is
+// required as bearer token, the API can disconnect users and must never be open.
+func (ftpserver *FtpServer) StartAdmin(addr, token string) error {
+	if token == "" {
+		return fmt.Errorf("The admin API requires a token")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Println(http.Serve(ln, ftp_admin.NewHandler(ftpserver, token)))
+	}()
+	return nil
+}
+
+// Sessions returns the active sessions.
+func (ftpserver *FtpServer) Sessions() []ftp_admin.Session {
+	ftpserver.sessionsMu.Lock()
+	defer ftpserver.sessionsMu.Unlock()
+	sessions := make([]ftp_admin.Session, 0, len(ftpserver.sessions))
+	for id, cc := range ftpserver.sessions {
+		status := cc.Status()
+		sessions = append(sessions, ftp_admin.Session{
+			ID:          id,
+			User:        status.User,
+			RemoteAddr:  status.RemoteAddr,
+			Cwd:         status.Cwd,
+			Transfer:    status.Transfer,
+			Transferred: status.Transferred,
+			Size:        status.Size,
+			IdleSeconds: status.Idle.Seconds(),
+		})
+	}
+	return sessions
+}
+
+// Disconnect closes the session with the given id and reports whether it existed.
+func (ftpserver *FtpServer) Disconnect(id uint64) bool {
+	ftpserver.sessionsMu.Lock()
+	cc, ok := ftpserver.sessions[id]
+	ftpserver.sessionsMu.Unlock()
+	if ok {
+		cc.Close()
+	}
+	return ok
+}
+
+// DisconnectUser closes all sessions of user and returns the number of closed sessions.
+func (ftpserver *FtpServer) DisconnectUser(user string) int {
+	ftpserver.sessionsMu.Lock()
+	var sessions []*client_connection.ClientConnection
+	for _, cc := range ftpserver.sessions {
+		if cc.Status().User == user {
+			sessions = append(sessions, cc)
+		}
+	}
+	ftpserver.sessionsMu.Unlock()
+	for _, cc := range sessions {
+		cc.Close()
+	}
+	return len(sessions)
+}
+
+// SetMaintenance enables or disables maintenance mode, in which logins are refused with 421. Sessions that
+// are already logged in are not affected.
+func (ftpserver *FtpServer) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&ftpserver.maintenance, value)
+}
+
+func (ftpserver *FtpServer) Maintenance() bool {
+	return atomic.LoadInt32(&ftpserver.maintenance) == 1
+}
+
 // Private Methods
 
+func (ftpserver *FtpServer) addSession(cc *client_connection.ClientConnection) uint64 {
+	ftpserver.sessionsMu.Lock()
+	defer ftpserver.sessionsMu.Unlock()
+	ftpserver.nextID++
+	ftpserver.sessions[ftpserver.nextID] = cc
+	return ftpserver.nextID
+}
+
+func (ftpserver *FtpServer) removeSession(id uint64) {
+	ftpserver.sessionsMu.Lock()
+	defer ftpserver.sessionsMu.Unlock()
+	delete(ftpserver.sessions, id)
+}
+
+func (ftpserver *FtpServer) statuses() []client_connection.Status {
+	ftpserver.sessionsMu.Lock()
+	defer ftpserver.sessionsMu.Unlock()
+	statuses := make([]client_connection.Status, 0, len(ftpserver.sessions))
+	for _, cc := range ftpserver.sessions {
+		statuses = append(statuses, cc.Status())
+	}
+	return statuses
+}
+
+func (ftpserver *FtpServer) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		log.Printf("New connection accepted from %s.\n", conn.RemoteAddr())
+		go ftpserver.handle(conn)
+	}
+}
+
 func (ftpserver *FtpServer) handle(conn net.Conn) {
-	cc := client_connection.New(conn, ftpserver.usrAuthCh, ftpserver.root, ftpserver.ip)
+	defer conn.Close()
+	if ftpserver.proxies.Contains(conn.RemoteAddr()) {
+		proxyConn, err := ftp_proxy.NewConn(conn, proxyHeaderTimeout)
+		if err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s.\n", conn.RemoteAddr(), err)
+			return
+		}
+		log.Printf("Connection from %s proxied by %s.\n", proxyConn.RemoteAddr(), proxyConn.ProxyAddr())
+		conn = proxyConn
+	}
+	certUser := ""
+	if ftpserver.tlsConfig != nil {
+		tlsConn, err := ftpserver.handshake(conn)
+		if err != nil {
+			log.Printf("TLS handshake with %s failed: %s.\n", conn.RemoteAddr(), err)
+			return
+		}
+		conn = tlsConn
+		certUser = ftpserver.certificateUser(tlsConn)
+	}
+	if ftpserver.recordDir != "" {
+		conn = ftpserver.record(conn)
+	}
+	cc := client_connection.New(conn, ftpserver.usrAuthCh, ftpserver.root, ftpserver.passiveIP(conn))
+	cc.SetCertificateUser(certUser)
+	cc.SetTLSConfig(ftpserver.tlsConfig)
+	cc.SetHooks(ftpserver.hooks)
+	cc.SetQuotaManager(ftpserver.quota)
+	cc.SetLockManager(ftpserver.locks)
+	defer cc.Close()
+	cc.SetFollowSymlinks(ftpserver.symlinks)
+	cc.SetMounts(ftpserver.mounts)
+	cc.SetFXPUsers(ftpserver.fxpUsers)
+	cc.SetVerifyPassiveIP(!ftpserver.anyPasvIP)
+	cc.SetMaintenance(ftpserver.Maintenance)
+	cc.SetCommands(ftpserver.handlers)
+	cc.SetSiteCommands(ftpserver.site)
+	cc.SetAdmins(ftpserver.admins)
+	cc.SetSessions(ftpserver.statuses)
+	cc.SetFallbackCharset(ftpserver.charset)
+	cc.SetVirtualHosts(ftpserver.hosts)
+	cc.SetUploadFilter(ftpserver.uploads)
+	id := ftpserver.addSession(cc)
+	defer ftpserver.removeSession(id)
+	ftpserver.hooks.OnConnect(cc.Session())
+	defer func() { ftpserver.hooks.OnDisconnect(cc.Session()) }()
 	if err := cc.SendWelcomeMsg(); err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		return
 	}
 Loop:
 	for {
 		cmd, err := cc.Command()
 		if err != nil {
-			fmt.Println(err.Error())
+			log.Println(err.Error())
 			switch err.(type) {
 			case *ftp_error.NotImplementedError:
 				continue
@@ -74,7 +487,7 @@ Loop:
 			}
 		}
 		if err := cc.Reply(cmd); err != nil {
-			fmt.Println(err.Error())
+			log.Println(err.Error())
 			continue
 		}
 	}
@@ -82,12 +495,161 @@ Loop:
 
 }
 
+// handshake starts TLS on conn.
+func (ftpserver *FtpServer) handshake(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, ftpserver.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// certificateUser returns the user that the client certificate presented on conn maps to, or "" if there is
+// none.
+func (ftpserver *FtpServer) certificateUser(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if ftpserver.certs == nil || len(certs) == 0 {
+		return ""
+	}
+	user, err := ftpserver.certs.User(certs)
+	if err != nil {
+		log.Printf("Client certificate of %s rejected: %s.\n", conn.RemoteAddr(), err)
+		return ""
+	}
+	log.Printf("Client certificate of %s maps to %s.\n", conn.RemoteAddr(), user)
+	return user
+}
+
+// passiveIP returns the IP advertised in PASV replies. If the server isn't bound to a specific IP, which is
+// common under inetd and socket activation, it is the IP the client connected to.
+func (ftpserver *FtpServer) passiveIP(conn net.Conn) string {
+	if ftpserver.ip != "" {
+		return ftpserver.ip
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil && !addr.IP.IsUnspecified() {
+		return addr.IP.String()
+	}
+	return ftpserver.ip
+}
+
+// record returns conn wrapped so that it is recorded to a new transcript file, or conn itself if the file
+// can't be created.
+func (ftpserver *FtpServer) record(conn net.Conn) net.Conn {
+	remote := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+	name := fmt.Sprintf("%s_%s.log", time.Now().UTC().Format("20060102T150405.000000000"), remote)
+	file, err := os.Create(filepath.Join(ftpserver.recordDir, name))
+	if err != nil {
+		log.Printf("Can't record session: %s.\n", err)
+		return conn
+	}
+	return ftp_record.NewConn(conn, file)
+}
+
 func (ftpserver *FtpServer) startAuthChannel() {
 	for authPkg := range ftpserver.usrAuthCh {
-		pw, ok := ftpserver.users[authPkg.User]
+		if ftpserver.auth == nil {
+			authPkg.ReplyCh <- ftpserver.authenticate(authPkg)
+			continue
+		}
+		// External authenticators may be slow, they must not hold up other logins.
+		go func(authPkg client_connection.AuthPkg) {
+			authPkg.ReplyCh <- ftpserver.authenticate(authPkg)
+		}(authPkg)
+	}
+}
+
+// authenticate checks the password, and the TOTP code of users that require one.
+func (ftpserver *FtpServer) authenticate(authPkg client_connection.AuthPkg) client_connection.AuthReply {
+	if authPkg.Certificate {
+		return ftpserver.authenticateCertificate(authPkg)
+	}
+	password := authPkg.Password
+	user := totpUser{authPkg.Host, authPkg.User}
+	secret, hasTOTP := ftpserver.totp[user]
+	var counter int64
+	if hasTOTP {
+		if len(password) < ftp_totp.Digits {
+			return client_connection.AuthReply{}
+		}
+		split := len(password) - ftp_totp.Digits
+		c, ok := ftp_totp.Validate(secret, password[split:], time.Now())
 		if !ok {
-			authPkg.ReplyCh <- false
+			return client_connection.AuthReply{}
 		}
-		authPkg.ReplyCh <- pw == authPkg.Password
+		password, counter = password[:split], c
+	}
+	reply := ftpserver.checkPassword(authPkg, password)
+	if reply.OK && hasTOTP && !ftpserver.useTOTP(user, counter) {
+		return client_connection.AuthReply{}
+	}
+	return reply
+}
+
+// authenticateCertificate decides whether the user that a client certificate maps to may log in without
+// password. Users with a TOTP secret can't, since the code can only be sent with PASS, and without an
+// authenticator the user must be one of the users of the selected host.
+func (ftpserver *FtpServer) authenticateCertificate(authPkg client_connection.AuthPkg) client_connection.AuthReply {
+	if _, ok := ftpserver.totp[totpUser{authPkg.Host, authPkg.User}]; ok {
+		return client_connection.AuthReply{}
+	}
+	if ftpserver.auth != nil {
+		return ftpserver.askAuthenticator(authPkg, "")
+	}
+	users := ftpserver.users
+	if authPkg.Host != "" {
+		users = ftpserver.hostUsers[authPkg.Host]
+	}
+	_, ok := users[authPkg.User]
+	return client_connection.AuthReply{OK: ok}
+}
+
+// checkPassword checks the password with the authenticator, or the users of the virtual host if there is
+// none.
+func (ftpserver *FtpServer) checkPassword(authPkg client_connection.AuthPkg, password string) client_connection.AuthReply {
+	if ftpserver.auth != nil {
+		return ftpserver.askAuthenticator(authPkg, password)
+	}
+	users := ftpserver.users
+	if authPkg.Host != "" {
+		users = ftpserver.hostUsers[authPkg.Host]
+	}
+	pw, ok := users[authPkg.User]
+	return client_connection.AuthReply{OK: ok && pw == password}
+}
+
+// askAuthenticator lets the external authenticator decide, its answer sets the home directory and
+// permissions of the session.
+func (ftpserver *FtpServer) askAuthenticator(authPkg client_connection.AuthPkg, password string) client_connection.AuthReply {
+	resp, err := ftpserver.auth.Authenticate(ftp_auth.Request{
+		User:        authPkg.User,
+		Password:    password,
+		RemoteAddr:  authPkg.RemoteAddr,
+		Host:        authPkg.Host,
+		Certificate: authPkg.Certificate,
+	})
+	if err != nil {
+		log.Printf("Authentication of %s failed: %s.\n", authPkg.User, err)
+		return client_connection.AuthReply{}
+	}
+	return client_connection.AuthReply{OK: resp.Allow, Home: resp.Home, ReadOnly: resp.ReadOnly()}
+}
+
+// totpUser identifies a user with a TOTP secret, users of different virtual hosts are different users.
+type totpUser struct {
+	host string
+	user string
+}
+
+// useTOTP marks the TOTP code with counter as used by user. It returns false if the code, or a later one,
+// has been used already.
+func (ftpserver *FtpServer) useTOTP(user totpUser, counter int64) bool {
+	ftpserver.totpMu.Lock()
+	defer ftpserver.totpMu.Unlock()
+	if counter <= ftpserver.totpUsed[user] {
+		return false
 	}
+	ftpserver.totpUsed[user] = counter
+	return true
 }
@@ -0,0 +1,246 @@
+package ftp_server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_auth"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_ip"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_server"
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_totp"
+	"github.com/jakobsvenningsson/go_ftp/pkg/test_utils"
+)
+
+func newCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertificateLogin(t *testing.T) {
+	ca := newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	caKey := ca.PrivateKey.(*ecdsa.PrivateKey)
+	serverCert := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca.Leaf, caKey)
+	clientCert := func(serial int64, cn string) []tls.Certificate {
+		return []tls.Certificate{newCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}, ca.Leaf, caKey)}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	root := os.TempDir()
+	srv := ftp_server.New(root, "127.0.0.1", "0")
+	srv.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	})
+	srv.SetCertificateMapper(ftp_auth.NewCertMapper(pool, ftp_auth.CertRule{Field: "cn", Pattern: "*"}))
+	secret, err := ftp_totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddHost("localhost", root, map[string]string{"web": "secret", "totp": "secret"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetTOTP("localhost", "totp", secret); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	var tests = []struct {
+		certs    []tls.Certificate
+		host     string
+		user     string
+		expected int
+	}{
+		{clientCert(3, "demo"), "", "demo", 232},
+		// The certificate only logs in the user it maps to.
+		{clientCert(4, "demo"), "", "web", 331},
+		{nil, "", "demo", 331},
+		// The user must be a user of the host.
+		{clientCert(5, "mallory"), "", "mallory", 331},
+		{clientCert(6, "web"), "", "web", 331},
+		{clientCert(7, "web"), "localhost", "web", 232},
+		{clientCert(8, "demo"), "localhost", "demo", 331},
+		// Users with a TOTP secret have to send the code with PASS.
+		{clientCert(9, "totp"), "localhost", "totp", 331},
+	}
+	for _, test := range tests {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: pool, Certificates: test.certs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctrl := textproto.NewConn(conn)
+		if _, _, err := ctrl.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		if test.host != "" {
+			if err := ctrl.PrintfLine("HOST %s", test.host); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := ctrl.ReadResponse(220); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ctrl.PrintfLine("USER %s", test.user); err != nil {
+			t.Fatal(err)
+		}
+		if code, msg, err := ctrl.ReadResponse(test.expected); err != nil {
+			t.Errorf("Error actual = %d %s, and Expected = %v.", code, msg, test.expected)
+		}
+		ctrl.Close()
+	}
+}
+
+func TestProtectedTransfer(t *testing.T) {
+	ca := newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca.Leaf, ca.PrivateKey.(*ecdsa.PrivateKey))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	root, err := ioutil.TempDir("", "ftp_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(root+"/test_file", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := ftp_server.New(root, "127.0.0.1", "0")
+	srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := textproto.NewConn(conn)
+	defer ctrl.Close()
+	if _, _, err := ctrl.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	var steps = []struct {
+		command  string
+		expected int
+	}{
+		{"USER demo", 331},
+		{"PASS password", 230},
+		{"PROT P", 503},
+		{"PBSZ 0", 200},
+		{"PROT S", 536},
+		{"PROT P", 200},
+	}
+	for _, step := range steps {
+		if err := ctrl.PrintfLine("%s", step.command); err != nil {
+			t.Fatal(err)
+		}
+		if code, msg, err := ctrl.ReadResponse(step.expected); err != nil {
+			t.Errorf("Error actual = %d %s, and Expected = %v.", code, msg, step.expected)
+		}
+	}
+
+	if err := ctrl.PrintfLine("PASV"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := ctrl.ReadResponse(227)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ftp_ip.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.PrintfLine("RETR test_file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ctrl.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(tls.Client(dataConn, config))
+	dataConn.Close()
+	if err != nil || string(data) != "Hello, World!" {
+		t.Errorf("Error actual = %q %v, and Expected = %q.", data, err, "Hello, World!")
+	}
+	if code, msg, err := ctrl.ReadResponse(226); err != nil {
+		t.Errorf("Error actual = %d %s, and Expected = %v.", code, msg, 226)
+	}
+}
+
+func TestStartAdmin(t *testing.T) {
+	srv := ftp_server.New(os.TempDir(), "127.0.0.1", "0")
+	err := srv.StartAdmin("127.0.0.1:0", "")
+	if ok, have, want := test_utils.VerifyError(err, errors.New("The admin API requires a token")); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", have, want)
+	}
+}
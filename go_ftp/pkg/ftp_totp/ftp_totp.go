@@ -0,0 +1,105 @@
+package ftp_totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters of the codes, the defaults of RFC 6238 which all authenticator apps support.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+)
+
+// 10^Digits
+const modulus = 1000000
+
+// Codes of this many periods before and after the current one are accepted, to allow for clock skew and
+// codes typed just before they expire.
+const skew = 1
+
+// The length of generated secrets in bytes, as recommended by RFC 4226.
+const secretLength = 20
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded as expected by authenticator apps.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, counter(t)), nil
+}
+
+// Validate reports whether the given code is valid for secret at time t. It also returns the counter of the
+// period the code belongs to, which callers can remember to reject codes that are used twice.
+func Validate(secret, given string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(given) != Digits {
+		return 0, false
+	}
+	now := counter(t)
+	for c := now - skew; c <= now+skew; c++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, c)), []byte(given)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth URI of secret, which authenticator apps import, usually from a QR code.
+func URI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// Private Methods
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("Invalid TOTP secret")
+	}
+	return key, nil
+}
+
+func counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// code computes the HOTP value of RFC 4226 for counter c.
+func code(key []byte, c int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(c))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
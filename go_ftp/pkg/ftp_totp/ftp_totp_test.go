@@ -0,0 +1,75 @@
+package ftp_totp_test
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/jakobsvenningsson/go_ftp/pkg/ftp_totp"
+)
+
+// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+var secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	var tests = []struct {
+		time     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code, err := ftp_totp.Code(secret, time.Unix(test.time, 0))
+		if err != nil || code != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", code, test.expected)
+		}
+	}
+	if _, err := ftp_totp.Code("not base32!", time.Now()); err == nil {
+		t.Errorf("Error actual = %v, and Expected = %v.", err, "Invalid TOTP secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	var tests = []struct {
+		code     string
+		at       time.Time
+		expected bool
+	}{
+		{"050471", now, true},
+		{"050471", now.Add(ftp_totp.Period), true},
+		{"050471", now.Add(-ftp_totp.Period), true},
+		{"050471", now.Add(3 * ftp_totp.Period), false},
+		{"050472", now, false},
+		{"50471", now, false},
+	}
+	for _, test := range tests {
+		if _, ok := ftp_totp.Validate(secret, test.code, test.at); ok != test.expected {
+			t.Errorf("Error actual = %v, and Expected = %v.", ok, test.expected)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := ftp_totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ftp_totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ftp_totp.Validate(secret, code, time.Now()); !ok {
+		t.Errorf("Error actual = %v, and Expected = %v.", ok, true)
+	}
+	uri := ftp_totp.URI("go_ftp", "alice", "JBSWY3DPEHPK3PXP")
+	expected := "otpauth://totp/go_ftp:alice?algorithm=SHA1&digits=6&issuer=go_ftp&period=30&secret=JBSWY3DPEHPK3PXP"
+	if uri != expected {
+		t.Errorf("Error actual = %v, and Expected = %v.", uri, expected)
+	}
+}